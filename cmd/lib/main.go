@@ -17,20 +17,32 @@ var ctx context.Context
 var cancel context.CancelFunc
 
 //export AuthFirebase
-// AuthFirebase will authenticate using Firebase flow and return the refresh token
+// AuthFirebase will authenticate using Firebase flow and return the refresh token,
+// the project ID is read from GOOGLE_CLOUD_PROJECT
 func AuthFirebase(title, port, clientID, clientSecret, apiKey, redirectURL *C.char) *C.char {
+	return authFirebase(title, port, clientID, clientSecret, apiKey, nil, redirectURL)
+}
+
+//export AuthFirebaseProject
+// AuthFirebaseProject will authenticate using Firebase flow for projectID and return the refresh token
+func AuthFirebaseProject(title, port, clientID, clientSecret, apiKey, projectID, redirectURL *C.char) *C.char {
+	return authFirebase(title, port, clientID, clientSecret, apiKey, projectID, redirectURL)
+}
+
+func authFirebase(title, port, clientID, clientSecret, apiKey, projectID, redirectURL *C.char) *C.char {
 	if cancel != nil {
 		cancel()
 	}
 	ctx, cancel = context.WithCancel(context.Background()) // Create a global context to use so we can cancel
 
 	a, err := fireb.New(fireb.Config{
-		Title:        C.GoString(title),
-		Port:         C.GoString(port),
-		ClientID:     C.GoString(clientID),
-		ClientSecret: C.GoString(clientSecret),
-		APIKey:       C.GoString(apiKey),
-		RedirectURL:  C.GoString(redirectURL),
+		Title:          C.GoString(title),
+		RedirectServer: fireb.RedirectServer{Port: C.GoString(port)},
+		ClientID:       C.GoString(clientID),
+		ClientSecret:   C.GoString(clientSecret),
+		APIKey:         C.GoString(apiKey),
+		ProjectID:      C.GoString(projectID),
+		RedirectURL:    C.GoString(redirectURL),
 	})
 
 	if err != nil {
@@ -38,8 +50,9 @@ func AuthFirebase(title, port, clientID, clientSecret, apiKey, redirectURL *C.ch
 		return nil
 	}
 
-	r := a.Auth(ctx)
-	if r == nil {
+	r, err := a.Auth(ctx)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to authenticate using Firebase: %v\n", err)
 		return nil
 	}
 
@@ -52,15 +65,27 @@ func AuthFirebase(title, port, clientID, clientSecret, apiKey, redirectURL *C.ch
 }
 
 //export ReauthFirebase
-// ReauthFirebase will get a new ID token using the provided refresh token and Firebase credentials
+// ReauthFirebase will get a new ID token using the provided refresh token and Firebase credentials,
+// the project ID is read from GOOGLE_CLOUD_PROJECT
 func ReauthFirebase(apiKey, refreshToken *C.char) *C.char {
+	return reauthFirebase(apiKey, nil, refreshToken)
+}
+
+//export ReauthFirebaseProject
+// ReauthFirebaseProject will get a new ID token for projectID using the provided refresh token and Firebase credentials
+func ReauthFirebaseProject(apiKey, projectID, refreshToken *C.char) *C.char {
+	return reauthFirebase(apiKey, projectID, refreshToken)
+}
+
+func reauthFirebase(apiKey, projectID, refreshToken *C.char) *C.char {
 	if cancel != nil {
 		cancel()
 	}
 	ctx, cancel = context.WithCancel(context.Background()) // Create a global context to use so we can cancel
 
 	a, err := fireb.New(fireb.Config{
-		APIKey: C.GoString(apiKey),
+		APIKey:    C.GoString(apiKey),
+		ProjectID: C.GoString(projectID),
 	})
 
 	if err != nil {
@@ -108,7 +133,11 @@ func Abort() {
 //		return nil
 //	}
 //
-//	r := a.Auth()
+//	r, err := a.Auth(ctx)
+//	if err != nil {
+//		_, _ = fmt.Fprintf(os.Stderr, "Failed to authenticate using PKCE: %v\n", err)
+//		return nil
+//	}
 //
 //	b, err := json.Marshal(r)
 //	if err != nil {
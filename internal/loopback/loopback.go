@@ -0,0 +1,428 @@
+package loopback
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"github.com/mousybusiness/authn/internal/static"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// ephemeralAttempts is the number of free ports tried when Port is "0",
+	// a port may be free on 127.0.0.1 but taken on ::1
+	ephemeralAttempts = 5
+	// shutdownTimeout bounds how long Wait lets the callback finish writing its response
+	shutdownTimeout = time.Second * 5
+)
+
+// ErrStateMismatch is returned when the callback's state parameter
+// is missing or doesn't match the authorization request.
+var ErrStateMismatch = errors.New("state mismatch in callback")
+
+type (
+	// Options for the redirect server, shared by the flows which receive
+	// the OAuth callback on the local machine.
+	Options struct {
+		// Port for localhosted redirect server if used, "0" selects a free port
+		// and a range e.g. "63353-63363" tries each port in turn. The chosen
+		// port is substituted into a localhost RedirectURL.
+		// default 63353
+		Port string
+		// SingleUse rejects further callbacks once the handler has responded
+		// with a 2xx status, callbacks are then handled one at a time
+		SingleUse bool
+		// TLS serves the redirect over HTTPS using a self-signed certificate
+		// generated for each login, for identity providers which refuse
+		// http redirect URIs. The certificate fingerprint is printed so the
+		// user can verify it when the browser warns about the certificate.
+		TLS bool
+		// CertFile and KeyFile are optional PEM encoded files which replace
+		// the generated certificate, setting them enables TLS
+		CertFile string
+		KeyFile  string
+	}
+
+	// Config for the redirect server used to receive OAuth callbacks.
+	Config struct {
+		Options
+		// RedirectURL the identity provider redirects to, if its host is
+		// loopback the chosen port is substituted as allowed by RFC 8252
+		RedirectURL string
+		// Path the handler is registered on
+		Path string
+		// Handler receives the callback
+		Handler http.HandlerFunc
+	}
+)
+
+// DefaultRedirectURL is used when a flow has no RedirectURL,
+// the listening port is substituted when the redirect server starts
+func (o Options) DefaultRedirectURL(path string) string {
+	if o.tls() {
+		return "https://localhost" + path
+	}
+
+	log.Warn("default redirection URL is unencrypted")
+	return "http://localhost" + path
+}
+
+func (o Options) tls() bool {
+	return o.TLS || o.CertFile != "" || o.KeyFile != ""
+}
+
+// Server is a running redirect server.
+// It only listens on 127.0.0.1 and ::1, and rejects requests whose Host
+// header doesn't match the redirect host to prevent DNS rebinding.
+type Server struct {
+	server    *http.Server
+	handler   http.HandlerFunc
+	path      string
+	hosts     map[string]bool
+	singleUse bool
+	mu        sync.Mutex
+	used      bool
+	done      chan struct{} // closed by Finish
+	once      sync.Once
+	err       error // passed to Finish
+	// Port the server is listening on
+	Port int
+	// RedirectURL with the chosen port substituted
+	RedirectURL string
+	// Fingerprint is the SHA-256 fingerprint of the certificate when serving TLS
+	Fingerprint string
+}
+
+// Listen binds the port synchronously so failures are returned
+// immediately rather than leaving Auth waiting on a callback
+// which can never arrive, then serves in the background.
+func Listen(config Config) (*Server, error) {
+	if config.Handler == nil {
+		return nil, errors.New("require Handler")
+	}
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	listeners, err := listen(config.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	port := listeners[0].Addr().(*net.TCPAddr).Port
+	redirectURL, err := substitutePort(config.RedirectURL, port)
+	if err != nil {
+		closeAll(listeners)
+		return nil, err
+	}
+
+	hosts, err := allowedHosts(redirectURL, port)
+	if err != nil {
+		closeAll(listeners)
+		return nil, err
+	}
+
+	s := &Server{
+		handler:     config.Handler,
+		path:        config.Path,
+		hosts:       hosts,
+		singleUse:   config.SingleUse,
+		done:        make(chan struct{}),
+		Port:        port,
+		RedirectURL: redirectURL,
+	}
+	s.server = &http.Server{
+		Handler: http.HandlerFunc(s.serveHTTP),
+	}
+
+	if tlsConfig != nil {
+		s.Fingerprint = fingerprint(tlsConfig.Certificates[0])
+		for i, l := range listeners {
+			listeners[i] = tls.NewListener(l, tlsConfig)
+		}
+	}
+
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			if err := s.server.Serve(l); err != nil && err != http.ErrServerClosed {
+				log.Error(errors.Wrap(err, "failed to serve login callback"))
+			}
+		}(l)
+	}
+
+	return s, nil
+}
+
+// Close immediately closes the server and any active connections.
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// Shutdown gracefully shuts down the server, waiting for active callbacks to complete.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// Finish is called by the handler when the callback has completed,
+// only the first call has any effect.
+func (s *Server) Finish(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+// Wait blocks until Finish is called or ctx is done, then shuts the server
+// down and returns the error passed to Finish.
+func (s *Server) Wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		if err := s.Close(); err != nil {
+			log.Error(errors.Wrap(err, "error while closing server"))
+		}
+		return errors.Wrap(ctx.Err(), "authentication cancelled")
+	case <-s.done:
+	}
+
+	// allow the callback to finish writing its response
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(sctx); err != nil {
+		log.Error(errors.Wrap(err, "error while shutting down server"))
+	}
+
+	return s.err
+}
+
+// VerifyState rejects callbacks which weren't initiated by this login, preventing CSRF.
+// On a mismatch the error page is written and Wait returns ErrStateMismatch.
+func (s *Server) VerifyState(w http.ResponseWriter, state, want, title string) bool {
+	if state != "" && subtle.ConstantTimeCompare([]byte(state), []byte(want)) == 1 {
+		return true
+	}
+
+	log.Error(ErrStateMismatch)
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = fmt.Fprintln(w, static.ErrorHTML(title, "The login request could not be verified, please try again."))
+	s.Finish(ErrStateMismatch)
+	return false
+}
+
+// newTLSConfig returns nil when the callback is served over plain HTTP
+func newTLSConfig(config Config) (*tls.Config, error) {
+	if !config.tls() {
+		return nil, nil
+	}
+
+	u, err := url.Parse(config.RedirectURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid redirect url")
+	}
+	if u.Scheme != "https" {
+		return nil, errors.New("redirect url must use https when serving TLS")
+	}
+
+	var cert tls.Certificate
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err = loadCertificate(config.CertFile, config.KeyFile)
+	} else {
+		cert, err = generateCertificate()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.hosts[strings.ToLower(r.Host)] {
+		log.Warnf("rejected callback with unexpected host %q", r.Host)
+		http.Error(w, "invalid host", http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Path != s.path {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !s.singleUse {
+		s.handler(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.used {
+		log.Warn("rejected repeated callback")
+		http.Error(w, "login callback has already been used", http.StatusGone)
+		return
+	}
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	s.handler(rec, r)
+	s.used = rec.status >= 200 && rec.status < 300
+}
+
+// statusRecorder captures the status written by the handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+func listen(port string) ([]net.Listener, error) {
+	first, last, err := parsePorts(port)
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := last - first + 1
+	if first == 0 {
+		attempts = ephemeralAttempts
+	}
+
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		p := first
+		if first != 0 {
+			p += i
+		}
+
+		listeners, err := listenLoopback(p)
+		if err == nil {
+			return listeners, nil
+		}
+		lastErr = err
+	}
+
+	return nil, errors.Wrapf(lastErr, "failed to listen for login callback on port %v", port)
+}
+
+// listenLoopback binds 127.0.0.1 and, when IPv6 is available, ::1 on the same
+// port as browsers may resolve localhost to either address. If ::1 is taken
+// the port is rejected so another process can't receive the callback.
+func listenLoopback(port int) ([]net.Listener, error) {
+	l4, err := net.Listen("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	port = l4.Addr().(*net.TCPAddr).Port
+	l6, err := net.Listen("tcp6", net.JoinHostPort("::1", strconv.Itoa(port)))
+	if err != nil {
+		if errors.Is(err, syscall.EADDRINUSE) {
+			_ = l4.Close()
+			return nil, err
+		}
+		log.Debugf("not listening on ::1: %v", err)
+		return []net.Listener{l4}, nil
+	}
+
+	return []net.Listener{l4, l6}, nil
+}
+
+func closeAll(listeners []net.Listener) {
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+}
+
+// allowedHosts returns the Host headers accepted by the server, the redirect
+// host and, for loopback redirects, each loopback name on the listening port
+func allowedHosts(redirectURL string, port int) (map[string]bool, error) {
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid redirect url")
+	}
+
+	hosts := map[string]bool{
+		strings.ToLower(u.Host): true,
+	}
+
+	if IsLoopback(u.Hostname()) {
+		for _, h := range []string{"localhost", "127.0.0.1", "::1"} {
+			hosts[net.JoinHostPort(h, strconv.Itoa(port))] = true
+		}
+	}
+
+	return hosts, nil
+}
+
+// parsePorts accepts a single port or an inclusive range e.g. "63353-63363"
+func parsePorts(port string) (int, int, error) {
+	parts := strings.SplitN(port, "-", 2)
+
+	first, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid port %q", port)
+	}
+
+	last := first
+	if len(parts) == 2 {
+		last, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return 0, 0, errors.Errorf("invalid port %q", port)
+		}
+	}
+
+	if first < 0 || last > 65535 || first > last || (first == 0 && last != 0) {
+		return 0, 0, errors.Errorf("invalid port %q", port)
+	}
+
+	return first, last, nil
+}
+
+// substitutePort replaces the port of loopback redirect URLs
+func substitutePort(redirectURL string, port int) (string, error) {
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid redirect url")
+	}
+
+	if !IsLoopback(u.Hostname()) {
+		return redirectURL, nil
+	}
+
+	u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+	return u.String(), nil
+}
+
+// IsLoopback reports whether host refers to the local machine.
+func IsLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
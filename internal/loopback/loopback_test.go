@@ -0,0 +1,147 @@
+package loopback
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func listenTest(t *testing.T, singleUse bool, status int) *Server {
+	t.Helper()
+	s, err := Listen(Config{
+		Options:     Options{Port: "0", SingleUse: singleUse},
+		RedirectURL: "http://localhost/callback",
+		Path:        "/callback",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func get(t *testing.T, s *Server, host, path string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d%s", s.Port, path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestServerRejectsRequests(t *testing.T) {
+	s := listenTest(t, false, http.StatusOK)
+
+	if !strings.HasPrefix(s.RedirectURL, fmt.Sprintf("http://localhost:%d/", s.Port)) {
+		t.Fatalf("RedirectURL = %q, want the port substituted", s.RedirectURL)
+	}
+
+	port := fmt.Sprint(s.Port)
+	tests := []struct {
+		name string
+		host string
+		path string
+		want int
+	}{
+		{name: "redirect host", host: "localhost:" + port, path: "/callback", want: http.StatusOK},
+		{name: "ipv4 loopback", host: "127.0.0.1:" + port, path: "/callback", want: http.StatusOK},
+		{name: "ipv6 loopback", host: "[::1]:" + port, path: "/callback", want: http.StatusOK},
+		{name: "rebound host", host: "attacker.example.com:" + port, path: "/callback", want: http.StatusBadRequest},
+		{name: "rebound host without port", host: "attacker.example.com", path: "/callback", want: http.StatusBadRequest},
+		{name: "wrong port", host: "localhost:1", path: "/callback", want: http.StatusBadRequest},
+		{name: "other path", host: "localhost:" + port, path: "/", want: http.StatusNotFound},
+		{name: "path prefix", host: "localhost:" + port, path: "/callback/extra", want: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := get(t, s, tt.host, tt.path); got != tt.want {
+				t.Fatalf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerSingleUse(t *testing.T) {
+	host := func(s *Server) string { return fmt.Sprintf("localhost:%d", s.Port) }
+
+	s := listenTest(t, true, http.StatusOK)
+	if got := get(t, s, host(s), "/callback"); got != http.StatusOK {
+		t.Fatalf("first callback status = %d, want %d", got, http.StatusOK)
+	}
+	if got := get(t, s, host(s), "/callback"); got != http.StatusGone {
+		t.Fatalf("second callback status = %d, want %d", got, http.StatusGone)
+	}
+
+	// failed callbacks don't use up the server
+	s = listenTest(t, true, http.StatusBadRequest)
+	for i := 0; i < 2; i++ {
+		if got := get(t, s, host(s), "/callback"); got != http.StatusBadRequest {
+			t.Fatalf("callback %d status = %d, want %d", i, got, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestServerVerifyState(t *testing.T) {
+	tests := []struct {
+		name  string
+		state string
+		want  int
+		err   error
+	}{
+		{name: "matching state", state: "expected", want: http.StatusOK},
+		{name: "missing state", state: "", want: http.StatusBadRequest, err: ErrStateMismatch},
+		{name: "other state", state: "attacker", want: http.StatusBadRequest, err: ErrStateMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s *Server
+			s, err := Listen(Config{
+				Options:     Options{Port: "0"},
+				RedirectURL: "http://localhost/callback",
+				Path:        "/callback",
+				Handler: func(w http.ResponseWriter, r *http.Request) {
+					if s.VerifyState(w, r.URL.Query().Get("state"), "expected", "Test") {
+						w.WriteHeader(http.StatusOK)
+						s.Finish(nil)
+					}
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = s.Close() })
+
+			if got := get(t, s, fmt.Sprintf("localhost:%d", s.Port), "/callback?state="+tt.state); got != tt.want {
+				t.Fatalf("status = %d, want %d", got, tt.want)
+			}
+			if err := s.Wait(context.Background()); err != tt.err {
+				t.Fatalf("Wait = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestServerWaitCancelled(t *testing.T) {
+	s := listenTest(t, false, http.StatusOK)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Wait = %v, want context.Canceled", err)
+	}
+}
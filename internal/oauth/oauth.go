@@ -0,0 +1,57 @@
+package oauth
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultScopes are requested when a flow isn't configured with Scopes
+// https://oauth.net/2/scope/
+var DefaultScopes = []string{
+	"email",
+	"profile",
+	"openid",
+	"offline_access",
+}
+
+// RefreshParams returns the parameters of a refresh token request. When the granted
+// scopes aren't known scope is empty and omitted, which RFC 6749 section 6 treats
+// as the scopes originally granted
+func RefreshParams(clientID, refreshToken, scope string) url.Values {
+	params := url.Values{}
+	params.Add("grant_type", "refresh_token")
+	params.Add("refresh_token", refreshToken)
+	params.Add("client_id", clientID)
+	if scope != "" {
+		params.Add("scope", scope)
+	}
+	return params
+}
+
+// PostForm sends a form encoded request which is aborted when ctx is done
+func PostForm(ctx context.Context, uri string, params url.Values) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, strings.NewReader(params.Encode()))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return resp.StatusCode, body, nil
+}
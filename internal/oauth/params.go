@@ -0,0 +1,79 @@
+package oauth
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// reserved parameters are set by the flows and can't be overridden by AuthParams.Extra
+var reserved = map[string]bool{
+	"client_id":             true,
+	"redirect_uri":          true,
+	"response_type":         true,
+	"scope":                 true,
+	"state":                 true,
+	"nonce":                 true,
+	"code_challenge":        true,
+	"code_challenge_method": true,
+}
+
+// AuthParams are optional authorization request parameters,
+// empty values aren't sent
+type AuthParams struct {
+	IDP       string
+	LoginHint string
+	Prompt    string
+	UILocales string
+	ACRValues string
+	MaxAge    time.Duration
+	Claims    string // JSON encoded OIDC claims request
+	Extra     map[string]string
+}
+
+// Validate checks Claims is a JSON object and Extra doesn't override reserved parameters
+func (a AuthParams) Validate() error {
+	if a.MaxAge < 0 {
+		return errors.New("MaxAge must not be negative")
+	}
+
+	if a.Claims != "" {
+		var claims map[string]interface{}
+		if err := json.Unmarshal([]byte(a.Claims), &claims); err != nil {
+			return errors.Wrap(err, "Claims must be a JSON object")
+		}
+	}
+
+	for k := range a.Extra {
+		if reserved[k] {
+			return errors.Errorf("parameter %q can't be overridden", k)
+		}
+	}
+
+	return nil
+}
+
+// Apply adds the parameters to an authorization request
+func (a AuthParams) Apply(params url.Values) {
+	set := func(k, v string) {
+		if v != "" {
+			params.Set(k, v)
+		}
+	}
+
+	set("idp", a.IDP)
+	set("login_hint", a.LoginHint)
+	set("prompt", a.Prompt)
+	set("ui_locales", a.UILocales)
+	set("acr_values", a.ACRValues)
+	set("claims", a.Claims)
+	if a.MaxAge > 0 {
+		params.Set("max_age", strconv.FormatInt(int64(a.MaxAge/time.Second), 10))
+	}
+
+	for k, v := range a.Extra {
+		params.Set(k, v)
+	}
+}
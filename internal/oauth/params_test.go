@@ -0,0 +1,96 @@
+package oauth
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuthParamsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  AuthParams
+		wantErr bool
+	}{
+		{name: "empty", params: AuthParams{}},
+		{name: "all set", params: AuthParams{
+			IDP:       "0oa1",
+			LoginHint: "user@example.com",
+			Prompt:    "login",
+			UILocales: "en",
+			ACRValues: "urn:mace:incommon:iap:silver",
+			MaxAge:    time.Minute,
+			Claims:    `{"id_token":{"acr":{"essential":true}}}`,
+			Extra:     map[string]string{"audience": "api"},
+		}},
+		{name: "negative max age", params: AuthParams{MaxAge: -time.Second}, wantErr: true},
+		{name: "claims not JSON", params: AuthParams{Claims: "acr"}, wantErr: true},
+		{name: "claims not an object", params: AuthParams{Claims: `["acr"]`}, wantErr: true},
+		{name: "extra overrides state", params: AuthParams{Extra: map[string]string{"state": "x"}}, wantErr: true},
+		{name: "extra overrides redirect", params: AuthParams{Extra: map[string]string{"redirect_uri": "https://attacker.example.com"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.params.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthParamsApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		params AuthParams
+		want   url.Values
+	}{
+		{name: "empty values aren't sent", params: AuthParams{}, want: url.Values{}},
+		{name: "all set", params: AuthParams{
+			IDP:       "0oa1",
+			LoginHint: "user@example.com",
+			Prompt:    "login",
+			UILocales: "en",
+			ACRValues: "silver",
+			Claims:    `{}`,
+			Extra:     map[string]string{"audience": "api"},
+		}, want: url.Values{
+			"idp":        {"0oa1"},
+			"login_hint": {"user@example.com"},
+			"prompt":     {"login"},
+			"ui_locales": {"en"},
+			"acr_values": {"silver"},
+			"claims":     {"{}"},
+			"audience":   {"api"},
+		}},
+		{name: "max age in seconds", params: AuthParams{MaxAge: time.Minute + time.Millisecond}, want: url.Values{"max_age": {"60"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := url.Values{}
+			tt.params.Apply(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Apply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefreshParams(t *testing.T) {
+	got := RefreshParams("client", "refresh", "")
+	want := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {"refresh"},
+		"client_id":     {"client"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("RefreshParams() = %v, want %v", got, want)
+	}
+
+	want.Set("scope", "openid email")
+	if got := RefreshParams("client", "refresh", "openid email"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("RefreshParams() = %v, want %v", got, want)
+	}
+}
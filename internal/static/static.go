@@ -2,6 +2,7 @@ package static
 
 import (
 	"github.com/pkg/errors"
+	"html"
 	"os/exec"
 	"runtime"
 	"strings"
@@ -72,13 +73,18 @@ const failedHTML = `<!DOCTYPE html>
     <div id="message">
       <h1>__TITLE__</h1>
       <h2>Login Failed</h2>
-      <p>Something went wrong.</p>
+      <p>__MESSAGE__</p>
     </div>
   </body>
 </html>`
 
 func FailedHTML(title string) string {
-	return strings.Replace(failedHTML, "__TITLE__", title, -1)
+	return ErrorHTML(title, "Something went wrong.")
+}
+
+// ErrorHTML is FailedHTML with a reason the user can act on
+func ErrorHTML(title, message string) string {
+	return strings.NewReplacer("__TITLE__", title, "__MESSAGE__", html.EscapeString(message)).Replace(failedHTML)
 }
 
 // Open attempts an os specific opening of transferred files or urls
@@ -4,6 +4,7 @@ package authn
 
 import "C"
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/mousybusiness/authn/pkg/creds"
@@ -11,15 +12,22 @@ import (
 	"os"
 )
 
-// AuthFirebase will authenticate using Firebase flow and return the refresh token
+// AuthFirebase will authenticate using Firebase flow and return the refresh token,
+// the project ID is read from GOOGLE_CLOUD_PROJECT
 func AuthFirebase(title, port, clientID, clientSecret, apiKey, redirectURL string) string {
+	return AuthFirebaseProject(title, port, clientID, clientSecret, apiKey, "", redirectURL)
+}
+
+// AuthFirebaseProject will authenticate using Firebase flow for projectID and return the refresh token
+func AuthFirebaseProject(title, port, clientID, clientSecret, apiKey, projectID, redirectURL string) string {
 	a, err := fireb.New(fireb.Config{
-		Title:        title,
-		Port:         port,
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
-		APIKey:       apiKey,
-		RedirectURL:  redirectURL,
+		Title:          title,
+		RedirectServer: fireb.RedirectServer{Port: port},
+		ClientID:       clientID,
+		ClientSecret:   clientSecret,
+		APIKey:         apiKey,
+		ProjectID:      projectID,
+		RedirectURL:    redirectURL,
 	})
 
 	if err != nil {
@@ -27,14 +35,25 @@ func AuthFirebase(title, port, clientID, clientSecret, apiKey, redirectURL strin
 		return ""
 	}
 
-	r := a.Auth()
+	r, err := a.Auth(context.Background())
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to authenticate using Firebase: %v\n", err)
+		return ""
+	}
 	return string(r.RefreshToken)
 }
 
-// ReauthFirebase will get a new ID token using the provided refresh token and Firebase credentials
+// ReauthFirebase will get a new ID token using the provided refresh token and Firebase credentials,
+// the project ID is read from GOOGLE_CLOUD_PROJECT
 func ReauthFirebase(apiKey, refreshToken string) string {
+	return ReauthFirebaseProject(apiKey, "", refreshToken)
+}
+
+// ReauthFirebaseProject will get a new ID token for projectID using the provided refresh token and Firebase credentials
+func ReauthFirebaseProject(apiKey, projectID, refreshToken string) string {
 	a, err := fireb.New(fireb.Config{
-		APIKey: apiKey,
+		APIKey:    apiKey,
+		ProjectID: projectID,
 	})
 
 	if err != nil {
@@ -42,7 +61,7 @@ func ReauthFirebase(apiKey, refreshToken string) string {
 		return ""
 	}
 
-	r, err := a.Refresh(creds.RefreshToken(refreshToken))
+	r, err := a.Refresh(context.Background(), creds.RefreshToken(refreshToken))
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "Failed to reauthenticate using Firebase, couldn't refresh token, err: %v\n", err)
 		return ""
@@ -74,7 +93,11 @@ func ReauthFirebase(apiKey, refreshToken string) string {
 //		return ""
 //	}
 //
-//	r := a.Auth()
+//	r, err := a.Auth(context.Background())
+//	if err != nil {
+//		_, _ = fmt.Fprintf(os.Stderr, "Failed to authenticate using PKCE: %v\n", err)
+//		return ""
+//	}
 //
 //	b, err := json.Marshal(r)
 //	if err != nil {
@@ -101,7 +124,7 @@ func ReauthFirebase(apiKey, refreshToken string) string {
 //		return ""
 //	}
 //
-//	r, err := a.Refresh(creds.RefreshToken(refreshToken))
+//	r, err := a.Refresh(context.Background(), creds.RefreshToken(refreshToken))
 //	if err != nil {
 //		_, _ = fmt.Fprintf(os.Stderr, "Failed to reauthenticate using PKCE, couldn't refresh token, err: %v\n", err)
 //		return ""
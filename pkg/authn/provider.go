@@ -0,0 +1,116 @@
+package authn
+
+import (
+	"context"
+	"github.com/mousybusiness/authn/pkg/creds"
+	"github.com/mousybusiness/authn/pkg/device"
+	"github.com/mousybusiness/authn/pkg/fireb"
+	"github.com/mousybusiness/authn/pkg/pkce"
+	"github.com/pkg/errors"
+	"sort"
+	"sync"
+)
+
+// Provider is implemented by every authentication flow so
+// callers can swap identity providers without recompiling.
+type Provider interface {
+	// Name identifies the provider in the registry
+	// e.g. "firebase"
+	Name() string
+
+	// Auth runs the interactive login flow
+	Auth(ctx context.Context) (*creds.Credentials, error)
+
+	// Refresh gets new credentials using the refresh token
+	// without requiring user input
+	Refresh(ctx context.Context, refreshToken creds.RefreshToken) (*creds.Credentials, error)
+
+	// Revoke invalidates the refresh token with the identity provider
+	Revoke(ctx context.Context, refreshToken creds.RefreshToken) error
+}
+
+var (
+	// ErrUnknownProvider is returned by Get when no provider is registered under the name
+	ErrUnknownProvider = errors.New("unknown provider")
+
+	providersMu sync.RWMutex
+	providers   = map[string]Provider{}
+)
+
+// Register makes the provider available by its Name.
+// Registering the same name twice returns an error.
+func Register(p Provider) error {
+	if p == nil {
+		return errors.New("require provider")
+	}
+
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	name := p.Name()
+	if _, ok := providers[name]; ok {
+		return errors.Errorf("provider %q already registered", name)
+	}
+	providers[name] = p
+	return nil
+}
+
+// Unregister removes the provider registered under name, if any.
+func Unregister(name string) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	delete(providers, name)
+}
+
+// Get returns the provider registered under name, typically
+// read from the caller's configuration.
+func Get(name string) (Provider, error) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	p, ok := providers[name]
+	if !ok {
+		return nil, errors.Wrap(ErrUnknownProvider, name)
+	}
+	return p, nil
+}
+
+// Providers returns the sorted names of all registered providers.
+func Providers() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewFirebase creates a Firebase flow as a Provider.
+func NewFirebase(config fireb.Config) (Provider, error) {
+	p, err := fireb.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// NewPKCE creates a PKCE flow as a Provider.
+func NewPKCE(config pkce.Config) (Provider, error) {
+	p, err := pkce.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// NewDevice creates a device authorization flow as a Provider.
+func NewDevice(config device.Config) (Provider, error) {
+	p, err := device.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
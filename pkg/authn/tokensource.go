@@ -0,0 +1,243 @@
+package authn
+
+import (
+	"context"
+	"github.com/mousybusiness/authn/pkg/creds"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLeeway         = time.Second * 30
+	defaultRefreshTimeout = time.Minute
+)
+
+type (
+	// TokenSourceConfig configures a TokenSource.
+	TokenSourceConfig struct {
+		// Provider used to refresh the credentials
+		Provider Provider
+
+		// Credentials to start with, if nil they are loaded from Store
+		Credentials *creds.Credentials
+
+		// Store is optional, rotated credentials are saved to it
+		Store creds.Store
+		// Profile the credentials are stored under, the provider
+		// is taken from Provider.Name()
+		// default "default"
+		Profile string
+
+		// Leeway before Expiry at which credentials are refreshed
+		// default 30 seconds
+		Leeway time.Duration
+
+		// RefreshTimeout bounds a refresh, which isn't cancelled with the
+		// context of the caller that started it as other callers share it
+		// default 1 minute
+		RefreshTimeout time.Duration
+	}
+
+	// TokenSource returns valid tokens on demand, refreshing them shortly
+	// before they expire. It is safe for concurrent use and only one
+	// refresh is in flight at a time regardless of the number of callers.
+	TokenSource struct {
+		provider Provider
+		store    creds.Store
+		key      creds.Key
+		leeway   time.Duration
+		timeout  time.Duration
+
+		mu          sync.Mutex
+		credentials *creds.Credentials
+		inflight    *refreshCall
+	}
+
+	// refreshCall is shared by every caller waiting on the same refresh
+	refreshCall struct {
+		done        chan struct{}
+		credentials *creds.Credentials
+		err         error
+	}
+)
+
+func NewTokenSource(config TokenSourceConfig) (*TokenSource, error) {
+	if config.Provider == nil {
+		return nil, errors.New("require Provider")
+	}
+
+	if config.Leeway == 0 {
+		config.Leeway = defaultLeeway
+	}
+
+	if config.RefreshTimeout == 0 {
+		config.RefreshTimeout = defaultRefreshTimeout
+	}
+
+	t := &TokenSource{
+		provider: config.Provider,
+		store:    config.Store,
+		key: creds.Key{
+			Profile:  config.Profile,
+			Provider: config.Provider.Name(),
+		},
+		leeway:  config.Leeway,
+		timeout: config.RefreshTimeout,
+	}
+
+	if config.Credentials != nil {
+		c := *config.Credentials
+		t.credentials = &c
+		return t, nil
+	}
+
+	if config.Store == nil {
+		return nil, errors.New("require Credentials or Store")
+	}
+
+	c, err := config.Store.Load(t.key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load credentials")
+	}
+	t.credentials = c
+
+	return t, nil
+}
+
+// Credentials returns a copy of the current credentials, refreshing them first if required.
+func (t *TokenSource) Credentials(ctx context.Context) (*creds.Credentials, error) {
+	t.mu.Lock()
+	if t.valid() {
+		c := *t.credentials
+		t.mu.Unlock()
+		return &c, nil
+	}
+	t.mu.Unlock()
+
+	return t.refresh(ctx, false)
+}
+
+// IDToken returns a valid ID token.
+func (t *TokenSource) IDToken(ctx context.Context) (creds.IDToken, error) {
+	c, err := t.Credentials(ctx)
+	if err != nil {
+		return "", err
+	}
+	return c.IDToken, nil
+}
+
+// AccessToken returns a valid access token.
+func (t *TokenSource) AccessToken(ctx context.Context) (creds.AccessToken, error) {
+	c, err := t.Credentials(ctx)
+	if err != nil {
+		return "", err
+	}
+	if c.AccessToken == "" {
+		return "", errors.Errorf("provider %q did not return an access token", t.provider.Name())
+	}
+	return c.AccessToken, nil
+}
+
+// Refresh forces a refresh regardless of expiry, e.g. when a token was rejected.
+// Concurrent callers share a single refresh.
+func (t *TokenSource) Refresh(ctx context.Context) (*creds.Credentials, error) {
+	return t.refresh(ctx, true)
+}
+
+// valid must be called with mu held
+func (t *TokenSource) valid() bool {
+	c := t.credentials
+	if c == nil || c.Expiry.IsZero() {
+		return false
+	}
+	if c.IDToken == "" && c.AccessToken == "" {
+		return false
+	}
+	return time.Now().Add(t.leeway).Before(c.Expiry)
+}
+
+// refresh joins the refresh in flight or starts a new one. Unless forced, credentials
+// refreshed by another caller since this caller found them expired are returned instead.
+func (t *TokenSource) refresh(ctx context.Context, force bool) (*creds.Credentials, error) {
+	t.mu.Lock()
+	call := t.inflight
+	if call == nil {
+		if !force && t.valid() {
+			c := *t.credentials
+			t.mu.Unlock()
+			return &c, nil
+		}
+
+		call = &refreshCall{
+			done: make(chan struct{}),
+		}
+		t.inflight = call
+		go t.run(call)
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-call.done:
+	}
+
+	if call.err != nil {
+		return nil, call.err
+	}
+
+	c := *call.credentials
+	return &c, nil
+}
+
+// run refreshes on a context detached from the callers, so cancelling
+// the caller which started the refresh doesn't fail the others
+func (t *TokenSource) run(call *refreshCall) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+
+	call.credentials, call.err = t.doRefresh(ctx)
+
+	t.mu.Lock()
+	t.inflight = nil
+	t.mu.Unlock()
+	close(call.done)
+}
+
+func (t *TokenSource) doRefresh(ctx context.Context) (*creds.Credentials, error) {
+	t.mu.Lock()
+	current := t.credentials
+	t.mu.Unlock()
+
+	if current == nil || current.RefreshToken == "" {
+		return nil, errors.New("require refresh token")
+	}
+
+	r, err := t.provider.Refresh(ctx, current.RefreshToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to refresh credentials")
+	}
+
+	// copy as providers may reuse the returned credentials
+	c := *r
+	if c.RefreshToken == "" {
+		c.RefreshToken = current.RefreshToken
+	}
+	if c.UID == "" {
+		c.UID = current.UID
+	}
+
+	t.mu.Lock()
+	t.credentials = &c
+	t.mu.Unlock()
+
+	if t.store != nil {
+		if err := t.store.Save(t.key, &c); err != nil {
+			log.Error(errors.Wrap(err, "failed to save refreshed credentials"))
+		}
+	}
+
+	return &c, nil
+}
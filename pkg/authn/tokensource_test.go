@@ -0,0 +1,162 @@
+package authn
+
+import (
+	"context"
+	"github.com/mousybusiness/authn/pkg/creds"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeProvider counts refreshes, each of which blocks until release is closed
+type fakeProvider struct {
+	refreshes int32
+	release   chan struct{}
+}
+
+func (p *fakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakeProvider) Auth(ctx context.Context) (*creds.Credentials, error) {
+	return nil, nil
+}
+
+func (p *fakeProvider) Refresh(ctx context.Context, refreshToken creds.RefreshToken) (*creds.Credentials, error) {
+	atomic.AddInt32(&p.refreshes, 1)
+	select {
+	case <-p.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &creds.Credentials{
+		IDToken: "fresh",
+		Expiry:  time.Now().Add(time.Hour),
+	}, nil
+}
+
+func (p *fakeProvider) Revoke(ctx context.Context, refreshToken creds.RefreshToken) error {
+	return nil
+}
+
+func newExpiredTokenSource(t *testing.T, p *fakeProvider) *TokenSource {
+	t.Helper()
+	ts, err := NewTokenSource(TokenSourceConfig{
+		Provider: p,
+		Credentials: &creds.Credentials{
+			IDToken:      "stale",
+			RefreshToken: "refresh",
+			Expiry:       time.Now().Add(-time.Minute),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func TestTokenSourceSingleFlight(t *testing.T) {
+	p := &fakeProvider{release: make(chan struct{})}
+	ts := newExpiredTokenSource(t, p)
+
+	const callers = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := ts.Credentials(context.Background())
+			if err == nil && c.IDToken != "fresh" {
+				t.Errorf("IDToken = %q, want %q", c.IDToken, "fresh")
+			}
+			errs <- err
+		}()
+	}
+
+	// let the callers pile up behind the first refresh
+	time.Sleep(time.Millisecond * 50)
+	close(p.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&p.refreshes); n != 1 {
+		t.Fatalf("provider refreshed %d times, want 1", n)
+	}
+
+	// callers arriving after the refresh use the new credentials
+	if _, err := ts.Credentials(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&p.refreshes); n != 1 {
+		t.Fatalf("provider refreshed %d times, want 1", n)
+	}
+}
+
+func TestTokenSourceLateCallersDontRefreshAgain(t *testing.T) {
+	p := &fakeProvider{release: make(chan struct{})}
+	close(p.release)
+	ts := newExpiredTokenSource(t, p)
+
+	if _, err := ts.Credentials(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a caller which saw the expired credentials before the refresh finished
+	if _, err := ts.refresh(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&p.refreshes); n != 1 {
+		t.Fatalf("provider refreshed %d times, want 1", n)
+	}
+
+	// a forced refresh always reaches the provider
+	if _, err := ts.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&p.refreshes); n != 2 {
+		t.Fatalf("provider refreshed %d times, want 2", n)
+	}
+}
+
+func TestTokenSourceCancelledLeader(t *testing.T) {
+	p := &fakeProvider{release: make(chan struct{})}
+	ts := newExpiredTokenSource(t, p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := ts.Credentials(ctx)
+		leader <- err
+	}()
+
+	// wait for the leader to start the refresh
+	for atomic.LoadInt32(&p.refreshes) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	follower := make(chan error, 1)
+	go func() {
+		_, err := ts.Credentials(context.Background())
+		follower <- err
+	}()
+
+	cancel()
+	if err := <-leader; err != context.Canceled {
+		t.Fatalf("leader error = %v, want %v", err, context.Canceled)
+	}
+
+	close(p.release)
+	if err := <-follower; err != nil {
+		t.Fatalf("follower failed after the leader was cancelled: %v", err)
+	}
+	if n := atomic.LoadInt32(&p.refreshes); n != 1 {
+		t.Fatalf("provider refreshed %d times, want 1", n)
+	}
+}
@@ -0,0 +1,136 @@
+package authn
+
+import (
+	"github.com/mousybusiness/authn/pkg/creds"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// TokenKind selects which token Transport sends as the bearer token.
+type TokenKind int
+
+const (
+	// IDToken sends creds.Credentials.IDToken, e.g. for APIs guarded by Firebase
+	IDToken TokenKind = iota
+	// AccessToken sends creds.Credentials.AccessToken, e.g. for APIs guarded by Okta
+	AccessToken
+)
+
+// Transport is an http.RoundTripper which authorizes requests with a bearer
+// token from Source. Tokens are refreshed ahead of expiry and a 401 response
+// triggers a single forced refresh and retry.
+type Transport struct {
+	// Source provides the tokens
+	Source *TokenSource
+	// Kind of token to send
+	// default IDToken
+	Kind TokenKind
+	// Base is the underlying RoundTripper
+	// default http.DefaultTransport
+	Base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Source == nil {
+		closeBody(req)
+		return nil, errors.New("require Source")
+	}
+
+	ctx := req.Context()
+	c, err := t.Source.Credentials(ctx)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+
+	token, err := t.token(c)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+
+	resp, err := t.base().RoundTrip(authorize(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// the request can't be retried if its body can't be replayed
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+
+	c, err = t.Source.Credentials(ctx)
+	if err != nil {
+		return resp, nil
+	}
+
+	// skip the forced refresh if another request already refreshed the token
+	retry, err := t.token(c)
+	if err != nil || retry == token {
+		if c, err = t.Source.Refresh(ctx); err != nil {
+			return resp, nil
+		}
+		if retry, err = t.token(c); err != nil {
+			return resp, nil
+		}
+	}
+
+	r := authorize(req, retry)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		r.Body = body
+	}
+
+	drain(resp)
+	return t.base().RoundTrip(r)
+}
+
+func (t *Transport) token(c *creds.Credentials) (string, error) {
+	var token string
+	switch t.Kind {
+	case IDToken:
+		token = string(c.IDToken)
+	case AccessToken:
+		token = string(c.AccessToken)
+	default:
+		return "", errors.Errorf("unknown token kind %d", t.Kind)
+	}
+
+	if token == "" {
+		return "", errors.New("credentials do not contain the requested token kind")
+	}
+	return token, nil
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+// authorize clones req as RoundTrippers must not modify the request
+func authorize(req *http.Request, token string) *http.Request {
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// drain discards the body so the connection can be reused
+func drain(resp *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
+
+// closeBody fulfils the RoundTripper contract of always closing the request body
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+}
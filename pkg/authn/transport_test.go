@@ -0,0 +1,197 @@
+package authn
+
+import (
+	"context"
+	"github.com/mousybusiness/authn/pkg/creds"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newValidTokenSource starts with unexpired credentials, refreshes aren't blocked
+func newValidTokenSource(t *testing.T, p *fakeProvider) *TokenSource {
+	t.Helper()
+	ts, err := NewTokenSource(TokenSourceConfig{
+		Provider: p,
+		Credentials: &creds.Credentials{
+			IDToken:      "initial",
+			AccessToken:  "access",
+			RefreshToken: "refresh",
+			Expiry:       time.Now().Add(time.Hour),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func newReleasedProvider() *fakeProvider {
+	p := &fakeProvider{release: make(chan struct{})}
+	close(p.release)
+	return p
+}
+
+// apiServer responds 401 unless the request is authorized with one of accepted
+// and echoes the request body, every Authorization header received is recorded
+func apiServer(t *testing.T, accepted ...string) (*httptest.Server, *[]string) {
+	t.Helper()
+	var received []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		received = append(received, auth)
+		for _, token := range accepted {
+			if auth == "Bearer "+token {
+				body, _ := ioutil.ReadAll(r.Body)
+				_, _ = w.Write(body)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(s.Close)
+	return s, &received
+}
+
+func TestTransportSendsToken(t *testing.T) {
+	tests := []struct {
+		name string
+		kind TokenKind
+		want string
+	}{
+		{name: "id token", kind: IDToken, want: "initial"},
+		{name: "access token", kind: AccessToken, want: "access"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, received := apiServer(t, tt.want)
+			client := &http.Client{Transport: &Transport{Source: newValidTokenSource(t, newReleasedProvider()), Kind: tt.kind}}
+
+			resp, err := client.Get(s.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			if got := (*received)[0]; got != "Bearer "+tt.want {
+				t.Fatalf("Authorization = %q, want %q", got, "Bearer "+tt.want)
+			}
+		})
+	}
+}
+
+func TestTransportRetriesUnauthorized(t *testing.T) {
+	p := newReleasedProvider()
+	s, received := apiServer(t, "fresh")
+	req, err := http.NewRequest(http.MethodPost, s.URL, strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &Transport{Source: newValidTokenSource(t, p)}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "payload" {
+		t.Fatalf("retried body = %q, want %q", body, "payload")
+	}
+	if n := atomic.LoadInt32(&p.refreshes); n != 1 {
+		t.Fatalf("refreshes = %d, want 1", n)
+	}
+	if len(*received) != 2 || (*received)[0] != "Bearer initial" || (*received)[1] != "Bearer fresh" {
+		t.Fatalf("Authorization headers = %q", *received)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Fatal("the caller's request was modified")
+	}
+}
+
+func TestTransportRetriesOnce(t *testing.T) {
+	p := newReleasedProvider()
+	s, received := apiServer(t)
+
+	client := &http.Client{Transport: &Transport{Source: newValidTokenSource(t, p)}}
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if n := atomic.LoadInt32(&p.refreshes); n != 1 {
+		t.Fatalf("refreshes = %d, want 1", n)
+	}
+	if len(*received) != 2 {
+		t.Fatalf("requests = %d, want 2", len(*received))
+	}
+}
+
+func TestTransportDoesntRetryUnreplayableBody(t *testing.T) {
+	p := newReleasedProvider()
+	s, received := apiServer(t, "fresh")
+	req, err := http.NewRequest(http.MethodPost, s.URL, ioutil.NopCloser(strings.NewReader("payload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &Transport{Source: newValidTokenSource(t, p)}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if n := atomic.LoadInt32(&p.refreshes); n != 0 {
+		t.Fatalf("refreshes = %d, want 0", n)
+	}
+	if len(*received) != 1 {
+		t.Fatalf("requests = %d, want 1", len(*received))
+	}
+}
+
+func TestTransportErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source bool
+		kind   TokenKind
+	}{
+		{name: "no source"},
+		{name: "unknown kind", source: true, kind: TokenKind(7)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &Transport{Kind: tt.kind}
+			if tt.source {
+				transport.Source = newValidTokenSource(t, newReleasedProvider())
+			}
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://127.0.0.1:1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := transport.RoundTrip(req); err == nil {
+				t.Fatal("RoundTrip() succeeded")
+			}
+		})
+	}
+}
@@ -24,5 +24,8 @@ type (
 		IDToken
 		RefreshToken
 		Expiry time.Time
+		// Claims of the verified IDToken, nil if the provider doesn't
+		// verify it. Claims aren't persisted by Store implementations.
+		Claims map[string]interface{}
 	}
 )
@@ -0,0 +1,467 @@
+package creds
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// encryptedVersion is incremented whenever the envelope format changes
+	encryptedVersion = 1
+
+	defaultEncryptedFilename = "credentials.enc.json"
+
+	kdfScrypt  = "scrypt"
+	kdfKeyFile = "keyfile"
+
+	keyLen  = 32 // AES-256
+	saltLen = 16
+
+	// scrypt cost parameters recommended for interactive logins
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+	// limits on the parameters read from a file, which are used before the file
+	// is authenticated, so a tampered file can't exhaust memory or CPU
+	maxScryptN      = 1 << 20
+	maxScryptMemory = 256 << 20 // scrypt uses 128*N*r bytes
+	maxScryptRP     = 16
+)
+
+// ErrTampered is returned when the encrypted file fails authentication,
+// either because it was modified or because the key is incorrect.
+var ErrTampered = errors.New("credentials file was modified or the key is incorrect")
+
+type (
+	// EncryptedFileStore stores credentials like FileStore but encrypts the file
+	// with AES-256-GCM so refresh tokens are never written in plaintext.
+	EncryptedFileStore struct {
+		path string
+		key  KeySource
+		mu   sync.Mutex
+	}
+
+	// KeySource provides the key used to encrypt the credentials file,
+	// see Passphrase and KeyFile.
+	KeySource interface {
+		// params returns the KDF parameters for newly encrypted files
+		params() (kdfParams, error)
+		// derive returns the encryption key for the file's KDF parameters
+		derive(p kdfParams) ([]byte, error)
+	}
+
+	// encryptedFile is the versioned envelope written to disk, the header
+	// fields are authenticated as additional data so they can't be altered
+	encryptedFile struct {
+		encryptedHeader
+		Nonce      []byte `json:"nonce"`
+		Ciphertext []byte `json:"ciphertext"`
+	}
+
+	encryptedHeader struct {
+		Version int       `json:"version"`
+		KDF     kdfParams `json:"kdf"`
+	}
+
+	kdfParams struct {
+		Name string `json:"name"`
+		Salt []byte `json:"salt,omitempty"`
+		N    int    `json:"n,omitempty"`
+		R    int    `json:"r,omitempty"`
+		P    int    `json:"p,omitempty"`
+	}
+
+	passphraseKey struct {
+		passphrase []byte
+		mu         sync.Mutex
+		salt       []byte // salt of the cached key
+		key        []byte // cached as scrypt is deliberately slow
+	}
+
+	fileKey struct {
+		path string
+	}
+)
+
+// Passphrase derives the encryption key from passphrase using scrypt,
+// an empty passphrase is rejected.
+func Passphrase(passphrase string) KeySource {
+	return &passphraseKey{
+		passphrase: []byte(passphrase),
+	}
+}
+
+// KeyFile reads the encryption key from path, which must contain
+// 32 random bytes either raw or base64 encoded. See GenerateKeyFile.
+func KeyFile(path string) KeySource {
+	return &fileKey{
+		path: path,
+	}
+}
+
+// GenerateKeyFile writes a new base64 encoded random key to path
+// readable only by the current user. An existing file is not overwritten.
+func GenerateKeyFile(path string) error {
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "failed to create key directory")
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create key file")
+	}
+
+	if _, err := f.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "failed to write key file")
+	}
+
+	return f.Close()
+}
+
+// NewEncryptedFileStore stores encrypted credentials at path,
+// if path is empty DefaultEncryptedFilePath is used.
+func NewEncryptedFileStore(path string, key KeySource) (*EncryptedFileStore, error) {
+	if key == nil {
+		return nil, errors.New("require KeySource")
+	}
+
+	if k, ok := key.(*passphraseKey); ok && len(k.passphrase) == 0 {
+		return nil, errors.New("require passphrase")
+	}
+
+	if path == "" {
+		p, err := DefaultEncryptedFilePath()
+		if err != nil {
+			return nil, err
+		}
+		path = p
+	}
+
+	return &EncryptedFileStore{
+		path: path,
+		key:  key,
+	}, nil
+}
+
+// DefaultEncryptedFilePath returns the encrypted credentials file within the user's config directory
+// e.g. "~/.config/authn/credentials.enc.json" on Linux
+func DefaultEncryptedFilePath() (string, error) {
+	p, err := DefaultFilePath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(p), defaultEncryptedFilename), nil
+}
+
+// Path returns the location of the encrypted credentials file.
+func (e *EncryptedFileStore) Path() string {
+	return e.path
+}
+
+func (e *EncryptedFileStore) Load(key Key) (*Credentials, error) {
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	file, _, err := e.read(e.key)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := file.Credentials[key.String()]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return s.credentials(), nil
+}
+
+func (e *EncryptedFileStore) Save(key Key, c *Credentials) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+
+	if c == nil {
+		return errors.New("require credentials")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	file, kdf, err := e.read(e.key)
+	if err != nil {
+		return err
+	}
+
+	file.Credentials[key.String()] = newStoredCredentials(c)
+	return e.write(file, e.key, kdf)
+}
+
+func (e *EncryptedFileStore) Delete(key Key) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	file, kdf, err := e.read(e.key)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := file.Credentials[key.String()]; !ok {
+		return nil
+	}
+
+	delete(file.Credentials, key.String())
+	return e.write(file, e.key, kdf)
+}
+
+// Rotate re-encrypts the credentials file with newKey, which is used
+// for all subsequent operations. A new salt is generated for passphrases.
+func (e *EncryptedFileStore) Rotate(newKey KeySource) error {
+	if newKey == nil {
+		return errors.New("require KeySource")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	file, _, err := e.read(e.key)
+	if err != nil {
+		return err
+	}
+
+	if err := e.write(file, newKey, nil); err != nil {
+		return err
+	}
+
+	e.key = newKey
+	return nil
+}
+
+// read decrypts the credentials file, returning an empty file and nil
+// KDF parameters if none exists yet
+func (e *EncryptedFileStore) read(ks KeySource) (*credentialsFile, *kdfParams, error) {
+	b, err := ioutil.ReadFile(e.path)
+	if os.IsNotExist(err) {
+		return newCredentialsFile(), nil, nil
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read credentials file")
+	}
+
+	var enc encryptedFile
+	if err := json.Unmarshal(b, &enc); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse credentials file")
+	}
+
+	if enc.Version > encryptedVersion {
+		return nil, nil, errors.Errorf("encrypted credentials file version %d is newer than supported version %d", enc.Version, encryptedVersion)
+	}
+
+	if enc.Version < 1 {
+		return nil, nil, errors.Errorf("encrypted credentials file version %d is invalid", enc.Version)
+	}
+
+	key, err := ks.derive(enc.KDF)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(enc.Nonce) != aead.NonceSize() {
+		return nil, nil, ErrTampered
+	}
+
+	ad, err := json.Marshal(enc.encryptedHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plain, err := aead.Open(nil, enc.Nonce, enc.Ciphertext, ad)
+	if err != nil {
+		return nil, nil, ErrTampered
+	}
+
+	file, err := parseFile(plain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return file, &enc.KDF, nil
+}
+
+// write encrypts the credentials file with a fresh nonce, kdf is reused
+// when set so passphrase keys don't need to be derived again
+func (e *EncryptedFileStore) write(file *credentialsFile, ks KeySource, kdf *kdfParams) error {
+	if kdf == nil {
+		p, err := ks.params()
+		if err != nil {
+			return err
+		}
+		kdf = &p
+	}
+
+	key, err := ks.derive(*kdf)
+	if err != nil {
+		return err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	plain, err := marshalFile(file)
+	if err != nil {
+		return err
+	}
+
+	enc := encryptedFile{
+		encryptedHeader: encryptedHeader{
+			Version: encryptedVersion,
+			KDF:     *kdf,
+		},
+		Nonce: make([]byte, aead.NonceSize()),
+	}
+
+	if _, err := io.ReadFull(rand.Reader, enc.Nonce); err != nil {
+		return err
+	}
+
+	ad, err := json.Marshal(enc.encryptedHeader)
+	if err != nil {
+		return err
+	}
+
+	enc.Ciphertext = aead.Seal(nil, enc.Nonce, plain, ad)
+
+	b, err := json.MarshalIndent(enc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return atomicWrite(e.path, b)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k *passphraseKey) params() (kdfParams, error) {
+	if len(k.passphrase) == 0 {
+		return kdfParams{}, errors.New("require passphrase")
+	}
+
+	salt := make([]byte, saltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return kdfParams{}, err
+	}
+
+	return kdfParams{
+		Name: kdfScrypt,
+		Salt: salt,
+		N:    scryptN,
+		R:    scryptR,
+		P:    scryptP,
+	}, nil
+}
+
+func (k *passphraseKey) derive(p kdfParams) ([]byte, error) {
+	if p.Name != kdfScrypt {
+		return nil, errors.Errorf("credentials file was encrypted using %q, not a passphrase", p.Name)
+	}
+
+	if len(k.passphrase) == 0 {
+		return nil, errors.New("require passphrase")
+	}
+
+	if err := p.validateScrypt(); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.key != nil && bytes.Equal(k.salt, p.Salt) {
+		return k.key, nil
+	}
+
+	key, err := scrypt.Key(k.passphrase, p.Salt, p.N, p.R, p.P, keyLen)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive key from passphrase")
+	}
+
+	k.salt = p.Salt
+	k.key = key
+	return key, nil
+}
+
+// validateScrypt bounds the cost parameters before deriving the key
+func (p kdfParams) validateScrypt() error {
+	if p.N < 2 || p.N > maxScryptN || p.N&(p.N-1) != 0 {
+		return errors.Errorf("invalid scrypt N %d in credentials file", p.N)
+	}
+
+	if p.R < 1 || p.P < 1 || p.R*p.P > maxScryptRP || 128*p.N*p.R > maxScryptMemory {
+		return errors.Errorf("invalid scrypt r %d and p %d in credentials file", p.R, p.P)
+	}
+	return nil
+}
+
+func (k *fileKey) params() (kdfParams, error) {
+	return kdfParams{
+		Name: kdfKeyFile,
+	}, nil
+}
+
+func (k *fileKey) derive(p kdfParams) ([]byte, error) {
+	if p.Name != kdfKeyFile {
+		return nil, errors.Errorf("credentials file was encrypted using %q, not a key file", p.Name)
+	}
+
+	b, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read key file")
+	}
+
+	if len(b) == keyLen {
+		return b, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil || len(key) != keyLen {
+		return nil, errors.Errorf("key file must contain %d raw or base64 encoded bytes", keyLen)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,213 @@
+package creds
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testKey = Key{Profile: "work", Provider: "pkce"}
+
+func TestEncryptedFileStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.enc.json")
+	store := newTestStore(t, path, Passphrase("correct horse"))
+
+	if _, err := store.Load(testKey); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Load() before Save error = %v, want ErrNotFound", err)
+	}
+
+	want := &Credentials{
+		UID:          "user",
+		IDToken:      "id",
+		RefreshToken: "refresh",
+		Expiry:       time.Now().Add(time.Hour).Truncate(time.Second),
+	}
+	if err := store.Save(testKey, want); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("refresh")) {
+		t.Fatal("refresh token written in plaintext")
+	}
+
+	got, err := newTestStore(t, path, Passphrase("correct horse")).Load(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UID != want.UID || got.RefreshToken != want.RefreshToken || !got.Expiry.Equal(want.Expiry) {
+		t.Fatalf("Load() = %+v, want %+v", got, want)
+	}
+}
+
+func TestEncryptedFileStoreTampered(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(f *encryptedFile)
+		key     KeySource
+		wantErr error // nil accepts any error
+	}{
+		{
+			name:    "ciphertext",
+			modify:  func(f *encryptedFile) { f.Ciphertext[0] ^= 0xff },
+			wantErr: ErrTampered,
+		},
+		{
+			name:    "nonce",
+			modify:  func(f *encryptedFile) { f.Nonce[0] ^= 0xff },
+			wantErr: ErrTampered,
+		},
+		{
+			name:    "truncated nonce",
+			modify:  func(f *encryptedFile) { f.Nonce = f.Nonce[:4] },
+			wantErr: ErrTampered,
+		},
+		{
+			name:    "salt",
+			modify:  func(f *encryptedFile) { f.KDF.Salt[0] ^= 0xff },
+			wantErr: ErrTampered,
+		},
+		{
+			name:    "wrong passphrase",
+			modify:  func(f *encryptedFile) {},
+			key:     Passphrase("battery staple"),
+			wantErr: ErrTampered,
+		},
+		{
+			name:   "huge N",
+			modify: func(f *encryptedFile) { f.KDF.N = 1 << 40 },
+		},
+		{
+			name:   "N not a power of two",
+			modify: func(f *encryptedFile) { f.KDF.N = 1<<15 + 1 },
+		},
+		{
+			name:   "huge r",
+			modify: func(f *encryptedFile) { f.KDF.R = 1 << 20 },
+		},
+		{
+			name:   "huge p",
+			modify: func(f *encryptedFile) { f.KDF.P = 1 << 20 },
+		},
+		{
+			name:   "key file",
+			modify: func(f *encryptedFile) { f.KDF = kdfParams{Name: kdfKeyFile} },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "credentials.enc.json")
+			if err := newTestStore(t, path, Passphrase("correct horse")).Save(testKey, &Credentials{RefreshToken: "refresh"}); err != nil {
+				t.Fatal(err)
+			}
+			modifyFile(t, path, tt.modify)
+
+			key := tt.key
+			if key == nil {
+				key = Passphrase("correct horse")
+			}
+
+			start := time.Now()
+			_, err := newTestStore(t, path, key).Load(testKey)
+			if err == nil {
+				t.Fatal("Load() succeeded for a tampered file")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Load() error = %v, want %v", err, tt.wantErr)
+			}
+			if time.Since(start) > time.Second*5 {
+				t.Fatalf("Load() took %v", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestEncryptedFileStoreRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "credentials.enc.json")
+	keyPath := filepath.Join(dir, "key")
+	if err := GenerateKeyFile(keyPath); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newTestStore(t, path, Passphrase("correct horse"))
+	if err := store.Save(testKey, &Credentials{RefreshToken: "refresh"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Rotate(KeyFile(keyPath)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the store keeps working with the new key
+	if err := store.Save(Key{Provider: "firebase"}, &Credentials{RefreshToken: "other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newTestStore(t, path, Passphrase("correct horse")).Load(testKey); err == nil {
+		t.Fatal("Load() with the old passphrase succeeded after rotation")
+	}
+
+	c, err := newTestStore(t, path, KeyFile(keyPath)).Load(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RefreshToken != "refresh" {
+		t.Fatalf("RefreshToken = %q, want %q", c.RefreshToken, "refresh")
+	}
+
+	if err := store.Rotate(Passphrase("battery staple")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTestStore(t, path, KeyFile(keyPath)).Load(testKey); err == nil {
+		t.Fatal("Load() with the old key file succeeded after rotation")
+	}
+	if _, err := newTestStore(t, path, Passphrase("battery staple")).Load(Key{Provider: "firebase"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedFileStoreEmptyPassphrase(t *testing.T) {
+	if _, err := NewEncryptedFileStore(filepath.Join(t.TempDir(), "credentials.enc.json"), Passphrase("")); err == nil {
+		t.Fatal("NewEncryptedFileStore() accepted an empty passphrase")
+	}
+}
+
+func newTestStore(t *testing.T, path string, key KeySource) *EncryptedFileStore {
+	t.Helper()
+	store, err := NewEncryptedFileStore(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func modifyFile(t *testing.T, path string, modify func(f *encryptedFile)) {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var f encryptedFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		t.Fatal(err)
+	}
+	modify(&f)
+
+	if b, err = json.Marshal(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, b, os.FileMode(0600)); err != nil {
+		t.Fatal(err)
+	}
+}
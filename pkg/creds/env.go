@@ -0,0 +1,85 @@
+package creds
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const defaultEnvPrefix = "AUTHN"
+
+var envUnsafe = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// EnvStore reads credentials from environment variables, which suits CI
+// pipelines where secrets are injected into the environment. It is read only.
+//
+// Variables are named PREFIX_PROFILE_PROVIDER_FIELD in upper case with
+// non-alphanumeric characters replaced by underscores
+// e.g. AUTHN_DEFAULT_FIREBASE_REFRESH_TOKEN
+//
+// Supported fields are UID, ACCESS_TOKEN, ID_TOKEN, REFRESH_TOKEN
+// and EXPIRY, which must be formatted as RFC 3339.
+type EnvStore struct {
+	prefix string
+}
+
+// NewEnvStore reads variables starting with prefix, if prefix is empty "AUTHN" is used.
+func NewEnvStore(prefix string) *EnvStore {
+	if prefix == "" {
+		prefix = defaultEnvPrefix
+	}
+
+	return &EnvStore{
+		prefix: prefix,
+	}
+}
+
+// Name returns the environment variable holding field for key
+// e.g. Name(Key{Provider: "firebase"}, "REFRESH_TOKEN")
+func (e *EnvStore) Name(key Key, field string) string {
+	key = key.normalize()
+	parts := []string{e.prefix, key.Profile, key.Provider, field}
+	for i, p := range parts {
+		parts[i] = strings.Trim(envUnsafe.ReplaceAllString(strings.ToUpper(p), "_"), "_")
+	}
+	return strings.Join(parts, "_")
+}
+
+func (e *EnvStore) Load(key Key) (*Credentials, error) {
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+
+	c := &Credentials{
+		UID:          os.Getenv(e.Name(key, "UID")),
+		AccessToken:  AccessToken(os.Getenv(e.Name(key, "ACCESS_TOKEN"))),
+		IDToken:      IDToken(os.Getenv(e.Name(key, "ID_TOKEN"))),
+		RefreshToken: RefreshToken(os.Getenv(e.Name(key, "REFRESH_TOKEN"))),
+	}
+
+	if c.RefreshToken == "" && c.IDToken == "" && c.AccessToken == "" {
+		return nil, ErrNotFound
+	}
+
+	if v := os.Getenv(e.Name(key, "EXPIRY")); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", e.Name(key, "EXPIRY"))
+		}
+		c.Expiry = t
+	}
+
+	return c, nil
+}
+
+// Save always returns ErrReadOnly.
+func (e *EnvStore) Save(key Key, c *Credentials) error {
+	return ErrReadOnly
+}
+
+// Delete always returns ErrReadOnly.
+func (e *EnvStore) Delete(key Key) error {
+	return ErrReadOnly
+}
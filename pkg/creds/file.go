@@ -0,0 +1,254 @@
+package creds
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// fileVersion is incremented whenever the on-disk schema changes,
+	// older versions must be migrated in readFile
+	fileVersion = 1
+
+	defaultDir      = "authn"
+	defaultFilename = "credentials.json"
+)
+
+type (
+	// FileStore keeps credentials for every profile and provider
+	// in a single JSON file readable only by the current user.
+	FileStore struct {
+		path string
+		mu   sync.Mutex
+	}
+
+	// credentialsFile is the versioned on-disk schema
+	credentialsFile struct {
+		Version     int                          `json:"version"`
+		Credentials map[string]storedCredentials `json:"credentials"`
+	}
+
+	// storedCredentials decouples the on-disk format from Credentials
+	// so fields can be added to Credentials without breaking stored files
+	storedCredentials struct {
+		UID          string    `json:"uid,omitempty"`
+		AccessToken  string    `json:"access_token,omitempty"`
+		IDToken      string    `json:"id_token,omitempty"`
+		RefreshToken string    `json:"refresh_token,omitempty"`
+		Expiry       time.Time `json:"expiry"`
+	}
+)
+
+// NewFileStore stores credentials at path, if path is empty DefaultFilePath is used.
+func NewFileStore(path string) (*FileStore, error) {
+	if path == "" {
+		p, err := DefaultFilePath()
+		if err != nil {
+			return nil, err
+		}
+		path = p
+	}
+
+	return &FileStore{
+		path: path,
+	}, nil
+}
+
+// DefaultFilePath returns the credentials file within the user's config directory
+// e.g. "~/.config/authn/credentials.json" on Linux
+func DefaultFilePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to find user config directory")
+	}
+	return filepath.Join(dir, defaultDir, defaultFilename), nil
+}
+
+// Path returns the location of the credentials file.
+func (f *FileStore) Path() string {
+	return f.path
+}
+
+func (f *FileStore) Load(key Key) (*Credentials, error) {
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := readFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := file.Credentials[key.String()]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return s.credentials(), nil
+}
+
+func (f *FileStore) Save(key Key, c *Credentials) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+
+	if c == nil {
+		return errors.New("require credentials")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := readFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	file.Credentials[key.String()] = newStoredCredentials(c)
+	return writeFile(f.path, file)
+}
+
+func (f *FileStore) Delete(key Key) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := readFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := file.Credentials[key.String()]; !ok {
+		return nil
+	}
+
+	delete(file.Credentials, key.String())
+	return writeFile(f.path, file)
+}
+
+// readFile returns an empty file if none exists yet
+func readFile(path string) (*credentialsFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return newCredentialsFile(), nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read credentials file")
+	}
+
+	return parseFile(b)
+}
+
+func newCredentialsFile() *credentialsFile {
+	return &credentialsFile{
+		Version:     fileVersion,
+		Credentials: map[string]storedCredentials{},
+	}
+}
+
+// parseFile decodes and validates the versioned schema
+func parseFile(b []byte) (*credentialsFile, error) {
+	file := newCredentialsFile()
+	if err := json.Unmarshal(b, file); err != nil {
+		return nil, errors.Wrap(err, "failed to parse credentials file")
+	}
+
+	if file.Version > fileVersion {
+		return nil, errors.Errorf("credentials file version %d is newer than supported version %d", file.Version, fileVersion)
+	}
+
+	if file.Version < 1 {
+		return nil, errors.Errorf("credentials file version %d is invalid", file.Version)
+	}
+
+	if file.Credentials == nil {
+		file.Credentials = map[string]storedCredentials{}
+	}
+
+	return file, nil
+}
+
+// writeFile atomically replaces the file so a crash never leaves it truncated
+func writeFile(path string, file *credentialsFile) error {
+	b, err := marshalFile(file)
+	if err != nil {
+		return err
+	}
+
+	return atomicWrite(path, b)
+}
+
+func marshalFile(file *credentialsFile) ([]byte, error) {
+	file.Version = fileVersion
+	return json.MarshalIndent(file, "", "  ")
+}
+
+// atomicWrite writes b to a temporary file readable only by the
+// current user and renames it over path
+func atomicWrite(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create credentials directory")
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary credentials file")
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if err := tmp.Chmod(0600); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "failed to set credentials file permissions")
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "failed to write credentials file")
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "failed to write credentials file")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to write credentials file")
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrap(err, "failed to replace credentials file")
+	}
+
+	return nil
+}
+
+func newStoredCredentials(c *Credentials) storedCredentials {
+	return storedCredentials{
+		UID:          c.UID,
+		AccessToken:  string(c.AccessToken),
+		IDToken:      string(c.IDToken),
+		RefreshToken: string(c.RefreshToken),
+		Expiry:       c.Expiry,
+	}
+}
+
+func (s storedCredentials) credentials() *Credentials {
+	return &Credentials{
+		UID:          s.UID,
+		AccessToken:  AccessToken(s.AccessToken),
+		IDToken:      IDToken(s.IDToken),
+		RefreshToken: RefreshToken(s.RefreshToken),
+		Expiry:       s.Expiry,
+	}
+}
@@ -0,0 +1,61 @@
+package creds
+
+import (
+	"github.com/pkg/errors"
+	"sync"
+)
+
+// MemoryStore keeps credentials for the lifetime of the process only.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	creds map[Key]Credentials
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		creds: map[Key]Credentials{},
+	}
+}
+
+func (m *MemoryStore) Load(key Key) (*Credentials, error) {
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	c, ok := m.creds[key.normalize()]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &c, nil
+}
+
+func (m *MemoryStore) Save(key Key, c *Credentials) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+
+	if c == nil {
+		return errors.New("require credentials")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.creds[key.normalize()] = *c
+	return nil
+}
+
+func (m *MemoryStore) Delete(key Key) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.creds, key.normalize())
+	return nil
+}
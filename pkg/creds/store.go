@@ -0,0 +1,53 @@
+package creds
+
+import (
+	"github.com/pkg/errors"
+)
+
+const defaultProfile = "default"
+
+var (
+	// ErrNotFound is returned by Store.Load when no credentials are stored for the key
+	ErrNotFound = errors.New("credentials not found")
+
+	// ErrReadOnly is returned when writing to a Store which cannot be modified
+	ErrReadOnly = errors.New("credential store is read only")
+)
+
+type (
+	// Key identifies a set of stored credentials.
+	// An empty Profile is treated as "default".
+	Key struct {
+		Profile  string
+		Provider string
+	}
+
+	// Store persists credentials between invocations.
+	Store interface {
+		// Load returns ErrNotFound if nothing is stored for the key
+		Load(key Key) (*Credentials, error)
+		Save(key Key, c *Credentials) error
+		// Delete does not return an error if nothing is stored for the key
+		Delete(key Key) error
+	}
+)
+
+// String returns the key as "profile/provider".
+func (k Key) String() string {
+	k = k.normalize()
+	return k.Profile + "/" + k.Provider
+}
+
+func (k Key) normalize() Key {
+	if k.Profile == "" {
+		k.Profile = defaultProfile
+	}
+	return k
+}
+
+func (k Key) validate() error {
+	if k.Provider == "" {
+		return errors.New("require Provider")
+	}
+	return nil
+}
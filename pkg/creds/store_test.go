@@ -0,0 +1,195 @@
+package creds
+
+import (
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testStore checks the behaviour every writable Store must share
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+
+	if _, err := store.Load(testKey); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Load() before Save error = %v, want ErrNotFound", err)
+	}
+
+	want := &Credentials{
+		UID:          "user",
+		AccessToken:  "access",
+		IDToken:      "id",
+		RefreshToken: "refresh",
+		Expiry:       time.Now().Add(time.Hour).Truncate(time.Second).UTC(),
+	}
+	if err := store.Save(testKey, want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Load(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Load() = %+v, want %+v", got, want)
+	}
+
+	other := Key{Profile: "home", Provider: testKey.Provider}
+	if _, err := store.Load(other); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Load() of another profile error = %v, want ErrNotFound", err)
+	}
+
+	if err := store.Save(Key{Provider: "default-profile"}, want); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(Key{Profile: "default", Provider: "default-profile"}); err != nil {
+		t.Fatalf("empty Profile wasn't stored as default, err = %v", err)
+	}
+
+	if err := store.Save(Key{Profile: "work"}, want); err == nil {
+		t.Fatal("Save() without a Provider succeeded")
+	}
+	if err := store.Save(testKey, nil); err == nil {
+		t.Fatal("Save() of nil credentials succeeded")
+	}
+
+	if err := store.Delete(testKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(testKey); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Load() after Delete error = %v, want ErrNotFound", err)
+	}
+	if err := store.Delete(testKey); err != nil {
+		t.Fatalf("Delete() of missing credentials error = %v", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authn", "credentials.json")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStore(t, store)
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Fatalf("file permissions = %v, want 0600", perm)
+		}
+	}
+
+	// a second store reads what the first wrote
+	if err := store.Save(testKey, &Credentials{RefreshToken: "persisted"}); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := reopened.Load(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RefreshToken != "persisted" {
+		t.Fatalf("RefreshToken = %q, want persisted", c.RefreshToken)
+	}
+}
+
+func TestFileStoreRejectsUnsupportedVersions(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+	}{
+		{name: "newer version", file: `{"version": 2, "credentials": {}}`},
+		{name: "invalid version", file: `{"version": 0, "credentials": {}}`},
+		{name: "not JSON", file: `refresh`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "credentials.json")
+			if err := ioutil.WriteFile(path, []byte(tt.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			store, err := NewFileStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Load(testKey); err == nil || errors.Is(err, ErrNotFound) {
+				t.Fatalf("Load() error = %v, want a parse error", err)
+			}
+		})
+	}
+}
+
+// setenv sets an environment variable for the duration of the test
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	prev, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(key, prev)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+}
+
+func TestEnvStore(t *testing.T) {
+	store := NewEnvStore("AUTHN_TEST")
+	key := Key{Profile: "ci-bot", Provider: "firebase"}
+
+	if got := store.Name(key, "REFRESH_TOKEN"); got != "AUTHN_TEST_CI_BOT_FIREBASE_REFRESH_TOKEN" {
+		t.Fatalf("Name() = %q", got)
+	}
+	if got := NewEnvStore("").Name(Key{Provider: "pkce"}, "UID"); got != "AUTHN_DEFAULT_PKCE_UID" {
+		t.Fatalf("Name() with defaults = %q", got)
+	}
+
+	if _, err := store.Load(key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Load() without variables error = %v, want ErrNotFound", err)
+	}
+
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	setenv(t, "AUTHN_TEST_CI_BOT_FIREBASE_UID", "user")
+	setenv(t, "AUTHN_TEST_CI_BOT_FIREBASE_REFRESH_TOKEN", "refresh")
+	setenv(t, "AUTHN_TEST_CI_BOT_FIREBASE_EXPIRY", expiry.Format(time.RFC3339))
+
+	got, err := store.Load(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Credentials{UID: "user", RefreshToken: "refresh", Expiry: expiry}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Load() = %+v, want %+v", got, want)
+	}
+
+	setenv(t, "AUTHN_TEST_CI_BOT_FIREBASE_EXPIRY", "tomorrow")
+	if _, err := store.Load(key); err == nil {
+		t.Fatal("Load() with an invalid EXPIRY succeeded")
+	}
+
+	if err := store.Save(key, got); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Save() error = %v, want ErrReadOnly", err)
+	}
+	if err := store.Delete(key); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Delete() error = %v, want ErrReadOnly", err)
+	}
+}
@@ -0,0 +1,393 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/mousybusiness/authn/internal/errs"
+	"github.com/mousybusiness/authn/internal/oauth"
+	"github.com/mousybusiness/authn/pkg/creds"
+	"github.com/mousybusiness/authn/pkg/oidc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultName     = "device"
+	defaultInterval = time.Second * 5
+	slowDownBackoff = time.Second * 5 // RFC 8628 section 3.5
+	deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+var (
+	// ErrExpired is returned when the device code expires before the user approves the request
+	ErrExpired = errors.New("device code expired")
+
+	// ErrDenied is returned when the user declines the authorization request
+	ErrDenied = errors.New("authorization request denied")
+)
+
+type (
+	deviceFlow struct {
+		config      Config
+		credentials *creds.Credentials
+		verifier    *oidc.Verifier
+		mu          sync.Mutex // guards credentials and scope, written by Auth and Refresh
+		scope       string     // granted by the last token response, reused on refresh
+	}
+
+	Config struct {
+		// Name identifies the provider when registered with authn
+		// default "device"
+		Name string
+
+		ClientID      string
+		Issuer        string // e.g. "https://oie-1234567.oktapreview.com/oauth2/default"
+		DeviceAuthURL string // e.g. "https://oie-1234567.oktapreview.com/oauth2/default/v1/device/authorize"
+		TokenURL      string // e.g. "https://oie-1234567.oktapreview.com/oauth2/default/v1/token"
+
+		// Scopes requested by Auth
+		// default []string{"email", "profile", "openid", "offline_access"}
+		Scopes []string
+
+		// RevokeURL is optional, Revoke will fail without it
+		RevokeURL string // e.g. "https://oie-1234567.oktapreview.com/oauth2/default/v1/revoke"
+		// JWKSURL is optional, discovered from Issuer if empty
+		JWKSURL string // e.g. "https://oie-1234567.oktapreview.com/oauth2/default/v1/keys"
+
+		// RequiredClaims must be present in every ID token
+		// e.g. []string{"email"}
+		RequiredClaims []string
+		// Verify is optional and runs after the standard ID token validation
+		Verify func(token *oidc.IDToken) error
+
+		// Output receives the verification instructions
+		// default os.Stdout
+		Output io.Writer
+	}
+
+	// AuthorizationResponse is returned by the device authorization endpoint
+	AuthorizationResponse struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURL         string `json:"verification_url"` // used by Google instead of verification_uri
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}
+
+	// TokenResponse is returned by the token endpoint
+	TokenResponse struct {
+		AccessToken      string  `json:"access_token"`
+		IDToken          string  `json:"id_token"`
+		RefreshToken     string  `json:"refresh_token"`
+		TokenType        string  `json:"token_type"`
+		ExpiresIn        float64 `json:"expires_in"`
+		Scope            string  `json:"scope"`
+		Error            string  `json:"error"`
+		ErrorDescription string  `json:"error_description"`
+	}
+)
+
+func New(config Config) (*deviceFlow, error) {
+	if config.ClientID == "" {
+		return nil, errors.New("require ClientID")
+	}
+
+	if config.Issuer == "" {
+		return nil, errors.New("require Issuer")
+	}
+
+	if config.DeviceAuthURL == "" {
+		return nil, errors.New("require DeviceAuthURL")
+	}
+
+	if config.TokenURL == "" {
+		return nil, errors.New("require TokenURL")
+	}
+
+	if config.Name == "" {
+		config.Name = defaultName
+	}
+
+	if len(config.Scopes) == 0 {
+		config.Scopes = oauth.DefaultScopes
+	}
+
+	if config.Output == nil {
+		config.Output = os.Stdout
+	}
+
+	checks := []func(token *oidc.IDToken) error{}
+	if config.Verify != nil {
+		checks = append(checks, config.Verify)
+	}
+
+	verifier, err := oidc.NewVerifier(oidc.VerifierConfig{
+		Issuer:         config.Issuer,
+		ClientID:       config.ClientID,
+		KeySet:         oidc.SharedKeySet(config.Issuer, config.JWKSURL),
+		RequiredClaims: config.RequiredClaims,
+		Checks:         checks,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &deviceFlow{
+		config:      config,
+		credentials: &creds.Credentials{},
+		verifier:    verifier,
+	}, nil
+}
+
+// Name returns the name the flow is registered under.
+func (d *deviceFlow) Name() string {
+	return d.config.Name
+}
+
+// Auth implements the OAuth 2.0 Device Authorization Grant (RFC 8628).
+// The verification URI and user code are printed so the user can approve
+// the request from any device with a browser, while Auth polls the token
+// endpoint until the request is approved, denied, expires or ctx is done.
+func (d *deviceFlow) Auth(ctx context.Context) (*creds.Credentials, error) {
+	auth, err := d.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	uri := auth.VerificationURI
+	if uri == "" {
+		uri = auth.VerificationURL
+	}
+
+	if auth.VerificationURIComplete != "" {
+		_, _ = fmt.Fprintf(d.config.Output, "Visit %v to authenticate, or visit %v and enter the code: %v\n", auth.VerificationURIComplete, uri, auth.UserCode)
+	} else {
+		_, _ = fmt.Fprintf(d.config.Output, "Visit %v and enter the code: %v\n", uri, auth.UserCode)
+	}
+
+	token, err := d.poll(ctx, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.toCredentials(ctx, token, nil)
+}
+
+func (d *deviceFlow) Refresh(ctx context.Context, refreshToken creds.RefreshToken) (*creds.Credentials, error) {
+	d.mu.Lock()
+	scope := d.scope
+	// the ID token is only kept if it was issued alongside refreshToken
+	previous := creds.Credentials{RefreshToken: refreshToken}
+	if d.credentials.RefreshToken == refreshToken {
+		previous = *d.credentials
+	}
+	d.mu.Unlock()
+	params := oauth.RefreshParams(d.config.ClientID, string(refreshToken), scope)
+
+	code, body, err := oauth.PostForm(ctx, d.config.TokenURL, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != http.StatusOK {
+		return nil, errs.NewHttpError(code, "error response from token exchange")
+	}
+
+	var token TokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, err
+	}
+
+	c, err := d.toCredentials(ctx, token, &previous)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("refresh successful!")
+
+	return c, nil
+}
+
+// Revoke invalidates the refresh token using the RFC 7009 revocation endpoint.
+func (d *deviceFlow) Revoke(ctx context.Context, refreshToken creds.RefreshToken) error {
+	if d.config.RevokeURL == "" {
+		return errors.New("require RevokeURL")
+	}
+
+	params := url.Values{}
+	params.Add("token", string(refreshToken))
+	params.Add("token_type_hint", "refresh_token")
+	params.Add("client_id", d.config.ClientID)
+
+	code, _, err := oauth.PostForm(ctx, d.config.RevokeURL, params)
+	if err != nil {
+		return err
+	}
+
+	if code != http.StatusOK {
+		return errs.NewHttpError(code, "error response from token revocation")
+	}
+
+	return nil
+}
+
+// authorize requests a device and user code
+func (d *deviceFlow) authorize(ctx context.Context) (AuthorizationResponse, error) {
+	params := url.Values{}
+	params.Add("client_id", d.config.ClientID)
+	params.Add("scope", strings.Join(d.config.Scopes, " "))
+
+	code, body, err := oauth.PostForm(ctx, d.config.DeviceAuthURL, params)
+	if err != nil {
+		return AuthorizationResponse{}, err
+	}
+
+	if code != http.StatusOK {
+		return AuthorizationResponse{}, errs.NewHttpError(code, fmt.Sprintf("error response from device authorization: %v", string(body)))
+	}
+
+	var r AuthorizationResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return AuthorizationResponse{}, err
+	}
+
+	if r.DeviceCode == "" || r.UserCode == "" || (r.VerificationURI == "" && r.VerificationURL == "") {
+		return AuthorizationResponse{}, errors.New("device authorization response missing device_code, user_code or verification_uri")
+	}
+
+	return r, nil
+}
+
+// poll the token endpoint until the user completes the request
+func (d *deviceFlow) poll(ctx context.Context, auth AuthorizationResponse) (TokenResponse, error) {
+	interval := defaultInterval
+	if auth.Interval > 0 {
+		interval = time.Duration(auth.Interval) * time.Second
+	}
+
+	// the device code expiring is reported separately from ctx's deadline
+	var expired <-chan time.Time
+	if auth.ExpiresIn > 0 {
+		timer := time.NewTimer(time.Duration(auth.ExpiresIn) * time.Second)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	params := url.Values{}
+	params.Add("grant_type", deviceGrantType)
+	params.Add("device_code", auth.DeviceCode)
+	params.Add("client_id", d.config.ClientID)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return TokenResponse{}, errors.Wrap(ctx.Err(), "authentication cancelled")
+		case <-expired:
+			return TokenResponse{}, ErrExpired
+		case <-time.After(interval):
+		}
+
+		code, body, err := oauth.PostForm(ctx, d.config.TokenURL, params)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue // reported by the select above
+			}
+			return TokenResponse{}, err
+		}
+
+		var token TokenResponse
+		if err := json.Unmarshal(body, &token); err != nil {
+			return TokenResponse{}, errs.NewHttpError(code, fmt.Sprintf("invalid token response: %v", string(body)))
+		}
+
+		if code == http.StatusOK {
+			return token, nil
+		}
+
+		switch token.Error {
+		case "authorization_pending":
+			log.Debugf("authorization pending")
+		case "slow_down":
+			interval += slowDownBackoff
+			log.Debugf("slowing down, polling every %v", interval)
+		case "expired_token":
+			return TokenResponse{}, ErrExpired
+		case "access_denied":
+			return TokenResponse{}, ErrDenied
+		default:
+			return TokenResponse{}, errs.NewHttpError(code, fmt.Sprintf("error response from token endpoint: %v %v", token.Error, token.ErrorDescription))
+		}
+	}
+}
+
+// toCredentials verifies the token response. On refresh previous is the credentials being
+// refreshed, whose ID and refresh tokens are kept when the response omits them as allowed
+// by RFC 6749 section 6 and OIDC Core section 12.2, so only the access token is required.
+func (d *deviceFlow) toCredentials(ctx context.Context, token TokenResponse, previous *creds.Credentials) (*creds.Credentials, error) {
+	if previous == nil && (token.IDToken == "" || token.RefreshToken == "" || token.ExpiresIn == 0) {
+		return nil, fmt.Errorf("unable to get data from response, accessToken: %v, idToken: %v, refreshToken: %v, expiresIn: %v", token.AccessToken != "", token.IDToken != "", token.RefreshToken != "", token.ExpiresIn != 0)
+	}
+
+	if previous != nil && token.AccessToken == "" {
+		return nil, errors.New("unable to get data from response, missing access token")
+	}
+
+	c := &creds.Credentials{
+		AccessToken:  creds.AccessToken(token.AccessToken),
+		IDToken:      creds.IDToken(token.IDToken),
+		RefreshToken: creds.RefreshToken(token.RefreshToken),
+	}
+
+	if token.IDToken != "" {
+		jwt, err := d.verifyJWT(ctx, c.IDToken, c.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		c.UID = jwt.Subject
+		c.Claims = jwt.Claims
+		c.Expiry = jwt.Expiry.Add(-time.Minute)
+	} else {
+		c.IDToken = previous.IDToken
+		c.UID = previous.UID
+		c.Claims = previous.Claims
+	}
+
+	if c.RefreshToken == "" {
+		c.RefreshToken = previous.RefreshToken
+	}
+
+	if token.ExpiresIn != 0 {
+		c.Expiry = time.Now().Add(time.Duration(token.ExpiresIn-60) * time.Second) // allow 1 minute of buffer
+	}
+
+	d.mu.Lock()
+	if token.Scope != "" {
+		d.scope = token.Scope
+	}
+	d.credentials = c
+	d.mu.Unlock()
+
+	return c, nil
+}
+
+func (d *deviceFlow) verifyJWT(ctx context.Context, token creds.IDToken, accessToken creds.AccessToken) (*oidc.IDToken, error) {
+	jwt, err := d.verifier.Verify(ctx, string(token), oidc.Expected{
+		AccessToken: string(accessToken),
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("JWT: %v", jwt.Claims)
+
+	return jwt, nil
+}
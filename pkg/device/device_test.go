@@ -0,0 +1,379 @@
+package device
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/mousybusiness/authn/pkg/creds"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID = "client"
+	testKeyID    = "key-1"
+)
+
+// testProvider fakes the device authorization, token and JWKS endpoints,
+// token responses are returned in order with the last one repeated
+type testProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu        sync.Mutex
+	authorize map[string]interface{}
+	responses []func() (int, map[string]interface{})
+	requests  []url.Values
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testProvider{
+		key: key,
+		authorize: map[string]interface{}{
+			"device_code":      "device-code",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": "https://example.com/device",
+			"expires_in":       600,
+			"interval":         1,
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		p.mu.Lock()
+		p.requests = append(p.requests, r.PostForm)
+		resp := p.authorize
+		p.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		p.mu.Lock()
+		p.requests = append(p.requests, r.PostForm)
+		next := p.responses[0]
+		if len(p.responses) > 1 {
+			p.responses = p.responses[1:]
+		}
+		p.mu.Unlock()
+
+		status, resp := next()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": testKeyID,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   "AQAB",
+			}},
+		})
+	})
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// respond queues token endpoint responses
+func (p *testProvider) respond(responses ...func() (int, map[string]interface{})) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.responses = responses
+}
+
+// received returns the form of each request made to the provider
+func (p *testProvider) received() []url.Values {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.requests
+}
+
+func (p *testProvider) newFlow(t *testing.T) *deviceFlow {
+	t.Helper()
+	d, err := New(Config{
+		ClientID:      testClientID,
+		Issuer:        p.URL,
+		DeviceAuthURL: p.URL + "/device",
+		TokenURL:      p.URL + "/token",
+		JWKSURL:       p.URL + "/keys",
+		Output:        ioutil.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// idToken signs an ID token for subject with the provider's key
+func (p *testProvider) idToken(t *testing.T, subject string) string {
+	t.Helper()
+	h, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": testKeyID})
+	c, _ := json.Marshal(map[string]interface{}{
+		"iss":   p.URL,
+		"aud":   testClientID,
+		"sub":   subject,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"email": subject + "@example.com",
+	})
+
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (p *testProvider) tokens(t *testing.T, subject, refreshToken string) func() (int, map[string]interface{}) {
+	idToken := p.idToken(t, subject)
+	return func() (int, map[string]interface{}) {
+		return http.StatusOK, map[string]interface{}{
+			"access_token":  "access-" + subject,
+			"id_token":      idToken,
+			"refresh_token": refreshToken,
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+			"scope":         "openid email",
+		}
+	}
+}
+
+func tokenError(code string) func() (int, map[string]interface{}) {
+	return func() (int, map[string]interface{}) {
+		return http.StatusBadRequest, map[string]interface{}{"error": code}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	p := newTestProvider(t)
+	p.respond(tokenError("authorization_pending"), p.tokens(t, "user", "refresh-1"))
+	d := p.newFlow(t)
+
+	c, err := d.Auth(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UID != "user" || c.AccessToken != "access-user" || c.RefreshToken != "refresh-1" || c.Claims["email"] != "user@example.com" {
+		t.Fatalf("Auth() = %+v", c)
+	}
+	if time.Until(c.Expiry) > time.Hour || time.Until(c.Expiry) < time.Minute*58 {
+		t.Fatalf("Expiry = %v, want about an hour", c.Expiry)
+	}
+
+	req := p.received()
+	if len(req) != 3 {
+		t.Fatalf("made %d requests, want an authorization and 2 polls", len(req))
+	}
+	if req[0].Get("client_id") != testClientID || req[0].Get("scope") != "email profile openid offline_access" {
+		t.Fatalf("authorization request = %v", req[0])
+	}
+	for _, r := range req[1:] {
+		if r.Get("grant_type") != deviceGrantType || r.Get("device_code") != "device-code" || r.Get("client_id") != testClientID {
+			t.Fatalf("token request = %v", r)
+		}
+	}
+}
+
+func TestAuthFails(t *testing.T) {
+	tests := []struct {
+		name      string
+		token     func() (int, map[string]interface{})
+		expiresIn int
+		timeout   time.Duration
+		wantErr   error
+	}{
+		{
+			name:    "denied",
+			token:   tokenError("access_denied"),
+			wantErr: ErrDenied,
+		},
+		{
+			name:    "expired_token",
+			token:   tokenError("expired_token"),
+			wantErr: ErrExpired,
+		},
+		{
+			name:      "expires_in passed",
+			token:     tokenError("authorization_pending"),
+			expiresIn: 1,
+			wantErr:   ErrExpired,
+		},
+		{
+			name:    "context deadline",
+			token:   tokenError("authorization_pending"),
+			timeout: time.Millisecond * 100,
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name:  "unexpected error",
+			token: tokenError("invalid_client"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvider(t)
+			p.respond(tt.token)
+			if tt.expiresIn != 0 {
+				p.authorize["expires_in"] = tt.expiresIn
+				p.authorize["interval"] = tt.expiresIn + 1
+			}
+			d := p.newFlow(t)
+
+			ctx := context.Background()
+			if tt.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			_, err := d.Auth(ctx)
+			if err == nil {
+				t.Fatal("Auth() succeeded, want an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Auth() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != ErrExpired && errors.Is(err, ErrExpired) {
+				t.Fatalf("Auth() error = %v, the device code didn't expire", err)
+			}
+		})
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	p := newTestProvider(t)
+	p.respond(p.tokens(t, "user", "refresh-1"))
+	d := p.newFlow(t)
+
+	last, err := d.Auth(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   func() (int, map[string]interface{})
+		refresh creds.RefreshToken
+		want    creds.Credentials
+		keepID  bool // keeps the ID token of the previous credentials
+		wantErr bool
+	}{
+		{
+			name:    "rotated",
+			token:   p.tokens(t, "user", "refresh-2"),
+			refresh: "refresh-1",
+			want:    creds.Credentials{UID: "user", AccessToken: "access-user", RefreshToken: "refresh-2"},
+		},
+		{
+			name: "only an access token",
+			token: func() (int, map[string]interface{}) {
+				return http.StatusOK, map[string]interface{}{"access_token": "access-2", "expires_in": 3600}
+			},
+			refresh: "refresh-2",
+			want:    creds.Credentials{UID: "user", AccessToken: "access-2", RefreshToken: "refresh-2"},
+			keepID:  true,
+		},
+		{
+			name: "another refresh token",
+			token: func() (int, map[string]interface{}) {
+				return http.StatusOK, map[string]interface{}{"access_token": "access-3", "expires_in": 3600}
+			},
+			refresh: "refresh-other",
+			want:    creds.Credentials{AccessToken: "access-3", RefreshToken: "refresh-other"},
+		},
+		{
+			name: "missing access token",
+			token: func() (int, map[string]interface{}) {
+				return http.StatusOK, map[string]interface{}{"expires_in": 3600}
+			},
+			refresh: "refresh-other",
+			wantErr: true,
+		},
+		{
+			name:    "error response",
+			token:   tokenError("invalid_grant"),
+			refresh: "refresh-other",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.respond(tt.token)
+			c, err := d.Refresh(context.Background(), tt.refresh)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Refresh() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.UID != tt.want.UID || c.AccessToken != tt.want.AccessToken || c.RefreshToken != tt.want.RefreshToken {
+				t.Fatalf("Refresh() = %+v, want %+v", c, tt.want)
+			}
+			if tt.keepID && c.IDToken != last.IDToken {
+				t.Fatal("Refresh() didn't keep the ID token")
+			}
+			if tt.want.UID == "" && c.IDToken != "" {
+				t.Fatal("Refresh() kept the ID token of another refresh token")
+			}
+			last = c
+			if tt.want.UID != "" && c.Claims["email"] != "user@example.com" {
+				t.Fatalf("Claims = %v", c.Claims)
+			}
+			if c.Expiry.IsZero() {
+				t.Fatal("Expiry not set")
+			}
+
+			req := p.received()
+			r := req[len(req)-1]
+			if r.Get("grant_type") != "refresh_token" || r.Get("refresh_token") != string(tt.refresh) || r.Get("scope") != "openid email" {
+				t.Fatalf("refresh request = %v", r)
+			}
+		})
+	}
+}
+
+func TestRefreshConcurrently(t *testing.T) {
+	p := newTestProvider(t)
+	p.respond(p.tokens(t, "user", "refresh-1"))
+	d := p.newFlow(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := d.Refresh(context.Background(), "refresh-1"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,216 @@
+package fireb
+
+import (
+	"context"
+	"github.com/mousybusiness/authn/pkg/creds"
+	"github.com/pkg/errors"
+	"time"
+)
+
+const (
+	// AttributeDisplayName removes the display name in AccountUpdate.Delete
+	AttributeDisplayName Attribute = "DISPLAY_NAME"
+	// AttributePhotoURL removes the photo URL in AccountUpdate.Delete
+	AttributePhotoURL Attribute = "PHOTO_URL"
+
+	oobVerifyEmail   = "VERIFY_EMAIL"
+	oobPasswordReset = "PASSWORD_RESET"
+	oobEmailSignIn   = "EMAIL_SIGNIN"
+)
+
+type (
+	// Attribute of a user which can be removed by UpdateAccount
+	Attribute string
+
+	// Account is the user returned by accounts:lookup
+	Account struct {
+		LocalID           string         `json:"localId"`
+		Email             string         `json:"email"`
+		EmailVerified     bool           `json:"emailVerified"`
+		DisplayName       string         `json:"displayName"`
+		PhotoURL          string         `json:"photoUrl"`
+		Disabled          bool           `json:"disabled"`
+		Providers         []ProviderInfo `json:"providerUserInfo"`
+		PasswordUpdatedAt float64        `json:"passwordUpdatedAt"` // milliseconds since the epoch
+		CreatedAt         string         `json:"createdAt"`         // milliseconds since the epoch
+		LastLoginAt       string         `json:"lastLoginAt"`       // milliseconds since the epoch
+		CustomAttributes  string         `json:"customAttributes"`  // JSON encoded custom claims
+	}
+
+	// ProviderInfo is a provider linked to an Account
+	ProviderInfo struct {
+		ProviderID  string `json:"providerId"`
+		FederatedID string `json:"federatedId"`
+		RawID       string `json:"rawId"`
+		Email       string `json:"email"`
+		DisplayName string `json:"displayName"`
+		PhotoURL    string `json:"photoUrl"`
+	}
+
+	// AccountUpdate changes the fields which aren't empty
+	AccountUpdate struct {
+		DisplayName string
+		PhotoURL    string
+		// Email is changed without verifying the new address
+		Email    string
+		Password string
+		// Delete removes attributes e.g. AttributeDisplayName
+		Delete []Attribute
+	}
+
+	lookupRequest struct {
+		IDToken string `json:"idToken"`
+	}
+
+	lookupResponse struct {
+		Users []Account `json:"users"`
+	}
+
+	updateRequest struct {
+		IDToken           string      `json:"idToken"`
+		DisplayName       string      `json:"displayName,omitempty"`
+		PhotoURL          string      `json:"photoUrl,omitempty"`
+		Email             string      `json:"email,omitempty"`
+		Password          string      `json:"password,omitempty"`
+		DeleteAttribute   []Attribute `json:"deleteAttribute,omitempty"`
+		ReturnSecureToken bool        `json:"returnSecureToken"`
+	}
+
+	updateResponse struct {
+		LocalID      string `json:"localId"`
+		IDToken      string `json:"idToken"`
+		RefreshToken string `json:"refreshToken"`
+	}
+
+	oobRequest struct {
+		RequestType        string `json:"requestType"`
+		IDToken            string `json:"idToken,omitempty"`
+		Email              string `json:"email,omitempty"`
+		ContinueURL        string `json:"continueUrl,omitempty"`
+		CanHandleCodeInApp bool   `json:"canHandleCodeInApp,omitempty"`
+	}
+
+	deleteRequest struct {
+		IDToken string `json:"idToken"`
+	}
+)
+
+// LookupAccount returns the account of the user signed in with c.
+// Account methods refresh c in place when its ID token has expired,
+// so save c afterwards to keep the new ID token.
+func (f *firebaseFlow) LookupAccount(ctx context.Context, c *creds.Credentials) (*Account, error) {
+	var resp lookupResponse
+	if err := f.withIDToken(ctx, c, func(idToken string) error {
+		return f.post(ctx, "lookup", lookupRequest{IDToken: idToken}, &resp)
+	}); err != nil {
+		return nil, err
+	}
+
+	if len(resp.Users) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return &resp.Users[0], nil
+}
+
+// UpdateAccount changes the profile, email or password of the user signed in with c.
+// Changing the email or password revokes the user's tokens, so c is replaced by the
+// credentials Firebase returns. Changing them after a while requires a recent login,
+// matched with errors.Is(err, ErrCredentialTooOld).
+func (f *firebaseFlow) UpdateAccount(ctx context.Context, c *creds.Credentials, u AccountUpdate) error {
+	var resp updateResponse
+	if err := f.withIDToken(ctx, c, func(idToken string) error {
+		return f.post(ctx, "update", updateRequest{
+			IDToken:           idToken,
+			DisplayName:       u.DisplayName,
+			PhotoURL:          u.PhotoURL,
+			Email:             u.Email,
+			Password:          u.Password,
+			DeleteAttribute:   u.Delete,
+			ReturnSecureToken: true,
+		}, &resp)
+	}); err != nil {
+		return err
+	}
+
+	if resp.IDToken == "" {
+		return nil
+	}
+
+	updated, err := f.linked(ctx, c, resp.LocalID, resp.IDToken, resp.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	*c = *updated
+	return nil
+}
+
+// SendEmailVerification emails a verification link to the user signed in with c.
+func (f *firebaseFlow) SendEmailVerification(ctx context.Context, c *creds.Credentials) error {
+	return f.withIDToken(ctx, c, func(idToken string) error {
+		return f.post(ctx, "sendOobCode", oobRequest{
+			RequestType: oobVerifyEmail,
+			IDToken:     idToken,
+		}, nil)
+	})
+}
+
+// SendPasswordReset emails a password reset link to email, it doesn't
+// require credentials as the user has usually forgotten their password.
+func (f *firebaseFlow) SendPasswordReset(ctx context.Context, email string) error {
+	if email == "" {
+		return errors.New("require email")
+	}
+
+	return f.post(ctx, "sendOobCode", oobRequest{
+		RequestType: oobPasswordReset,
+		Email:       email,
+	}, nil)
+}
+
+// DeleteAccount deletes the user signed in with c, c can't be used afterwards.
+// Like UpdateAccount it may require a recent login.
+func (f *firebaseFlow) DeleteAccount(ctx context.Context, c *creds.Credentials) error {
+	return f.withIDToken(ctx, c, func(idToken string) error {
+		return f.post(ctx, "delete", deleteRequest{IDToken: idToken}, nil)
+	})
+}
+
+// withIDToken calls fn with the ID token of c, refreshing c first if the token has
+// expired and retrying once if Firebase reports it expired, e.g. after clock skew
+func (f *firebaseFlow) withIDToken(ctx context.Context, c *creds.Credentials, fn func(idToken string) error) error {
+	if c == nil || (c.IDToken == "" && c.RefreshToken == "") {
+		return errors.New("require credentials with an IDToken or RefreshToken")
+	}
+
+	if c.IDToken == "" || !time.Now().Before(c.Expiry) {
+		if err := f.refreshCredentials(ctx, c); err != nil {
+			return err
+		}
+	}
+
+	err := fn(string(c.IDToken))
+	if !errors.Is(err, ErrTokenExpired) || c.RefreshToken == "" {
+		return err
+	}
+
+	if err := f.refreshCredentials(ctx, c); err != nil {
+		return err
+	}
+	return fn(string(c.IDToken))
+}
+
+// refreshCredentials replaces c with credentials from its refresh token
+func (f *firebaseFlow) refreshCredentials(ctx context.Context, c *creds.Credentials) error {
+	if c.RefreshToken == "" {
+		return errors.New("ID token expired and credentials have no RefreshToken")
+	}
+
+	r, err := f.Refresh(ctx, c.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	*c = *r
+	return nil
+}
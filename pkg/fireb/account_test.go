@@ -0,0 +1,223 @@
+package fireb
+
+import (
+	"context"
+	"github.com/mousybusiness/authn/pkg/creds"
+	"github.com/pkg/errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// signedIn are unexpired credentials for testUID
+func signedIn(t *testing.T) *creds.Credentials {
+	return &creds.Credentials{
+		UID:          testUID,
+		IDToken:      creds.IDToken(idToken(t, nil)),
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(time.Hour),
+	}
+}
+
+// handleRefresh responds to refreshes with an ID token distinguishable by its email
+func handleRefresh(t *testing.T, s *testServer) string {
+	refreshed := idToken(t, func(c map[string]interface{}) { c["email"] = "refreshed@example.com" })
+	s.handle("token", func(body map[string]interface{}) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{
+			"id_token":      refreshed,
+			"refresh_token": "rotated-refresh-token",
+			"user_id":       testUID,
+			"expires_in":    "3600",
+		}
+	})
+	return refreshed
+}
+
+func TestLookupAccount(t *testing.T) {
+	f, s := newTestFlow(t, Config{})
+	s.handle("lookup", func(body map[string]interface{}) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{
+			"users": []map[string]interface{}{{
+				"localId":          testUID,
+				"email":            "user@example.com",
+				"emailVerified":    true,
+				"providerUserInfo": []map[string]string{{"providerId": "password", "email": "user@example.com"}},
+			}},
+		}
+	})
+
+	c := signedIn(t)
+	account, err := f.LookupAccount(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.LocalID != testUID || !account.EmailVerified || len(account.Providers) != 1 || account.Providers[0].ProviderID != "password" {
+		t.Fatalf("LookupAccount() = %+v", account)
+	}
+	if req := s.received("lookup"); req[0]["idToken"] != string(c.IDToken) {
+		t.Fatalf("lookup request = %v", req[0])
+	}
+
+	s.handle("lookup", func(body map[string]interface{}) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{}
+	})
+	if _, err := f.LookupAccount(context.Background(), c); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("err = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestAccountRefreshesExpiredIDToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *creds.Credentials)
+		lookup func(calls int) (int, interface{}) // calls made before this one
+	}{
+		{
+			name:   "expired locally",
+			modify: func(c *creds.Credentials) { c.Expiry = time.Now().Add(-time.Minute) },
+		},
+		{
+			name:   "missing ID token",
+			modify: func(c *creds.Credentials) { c.IDToken = "" },
+		},
+		{
+			name:   "expired according to Firebase",
+			modify: func(c *creds.Credentials) {},
+			lookup: func(calls int) (int, interface{}) {
+				if calls == 0 {
+					return apiError("TOKEN_EXPIRED")(nil)
+				}
+				return http.StatusOK, map[string]interface{}{"users": []map[string]string{{"localId": testUID}}}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, s := newTestFlow(t, Config{})
+			refreshed := handleRefresh(t, s)
+			calls := 0
+			s.handle("lookup", func(body map[string]interface{}) (int, interface{}) {
+				defer func() { calls++ }()
+				if tt.lookup != nil {
+					return tt.lookup(calls)
+				}
+				return http.StatusOK, map[string]interface{}{"users": []map[string]string{{"localId": testUID}}}
+			})
+
+			c := signedIn(t)
+			tt.modify(c)
+			if _, err := f.LookupAccount(context.Background(), c); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(s.received("token")) != 1 {
+				t.Fatalf("refreshed %d times, want once", len(s.received("token")))
+			}
+			req := s.received("lookup")
+			if got := req[len(req)-1]["idToken"]; got != refreshed {
+				t.Fatal("lookup didn't use the refreshed ID token")
+			}
+			if c.IDToken != creds.IDToken(refreshed) || c.RefreshToken != "rotated-refresh-token" {
+				t.Fatalf("credentials weren't refreshed in place: %+v", c)
+			}
+		})
+	}
+}
+
+func TestAccountRequiresCredentials(t *testing.T) {
+	f, _ := newTestFlow(t, Config{})
+	for _, c := range []*creds.Credentials{nil, {UID: testUID}} {
+		if _, err := f.LookupAccount(context.Background(), c); err == nil {
+			t.Fatalf("LookupAccount(%+v) succeeded", c)
+		}
+	}
+
+	expired := &creds.Credentials{IDToken: "expired", Expiry: time.Now().Add(-time.Minute)}
+	if err := f.DeleteAccount(context.Background(), expired); err == nil {
+		t.Fatal("DeleteAccount() succeeded with an expired ID token and no refresh token")
+	}
+}
+
+func TestUpdateAccount(t *testing.T) {
+	t.Run("profile", func(t *testing.T) {
+		f, s := newTestFlow(t, Config{})
+		s.handle("update", func(body map[string]interface{}) (int, interface{}) {
+			return http.StatusOK, map[string]interface{}{"localId": testUID}
+		})
+
+		c := signedIn(t)
+		before := *c
+		err := f.UpdateAccount(context.Background(), c, AccountUpdate{DisplayName: "Goose", Delete: []Attribute{AttributePhotoURL}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.IDToken != before.IDToken || c.RefreshToken != before.RefreshToken {
+			t.Fatal("credentials changed without new tokens")
+		}
+
+		req := s.received("update")[0]
+		deleted, _ := req["deleteAttribute"].([]interface{})
+		if req["displayName"] != "Goose" || len(deleted) != 1 || deleted[0] != "PHOTO_URL" || req["email"] != nil || req["password"] != nil {
+			t.Fatalf("update request = %v", req)
+		}
+	})
+
+	t.Run("password revokes tokens", func(t *testing.T) {
+		f, s := newTestFlow(t, Config{})
+		replaced := idToken(t, func(c map[string]interface{}) { c["email"] = "replaced@example.com" })
+		s.handle("update", func(body map[string]interface{}) (int, interface{}) {
+			return http.StatusOK, map[string]interface{}{"localId": testUID, "idToken": replaced, "refreshToken": "new-refresh-token"}
+		})
+
+		c := signedIn(t)
+		if err := f.UpdateAccount(context.Background(), c, AccountUpdate{Password: "correct horse"}); err != nil {
+			t.Fatal(err)
+		}
+		if c.IDToken != creds.IDToken(replaced) || c.RefreshToken != "new-refresh-token" {
+			t.Fatalf("credentials weren't replaced: %+v", c)
+		}
+	})
+
+	t.Run("requires recent login", func(t *testing.T) {
+		f, s := newTestFlow(t, Config{})
+		s.handle("update", apiError("CREDENTIAL_TOO_OLD_LOGIN_AGAIN"))
+
+		if err := f.UpdateAccount(context.Background(), signedIn(t), AccountUpdate{Email: "new@example.com"}); !errors.Is(err, ErrCredentialTooOld) {
+			t.Fatalf("err = %v, want ErrCredentialTooOld", err)
+		}
+	})
+}
+
+func TestAccountEmails(t *testing.T) {
+	f, s := newTestFlow(t, Config{})
+	s.handle("sendOobCode", func(body map[string]interface{}) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{}
+	})
+	s.handle("delete", func(body map[string]interface{}) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{}
+	})
+
+	c := signedIn(t)
+	if err := f.SendEmailVerification(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SendPasswordReset(context.Background(), "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SendPasswordReset(context.Background(), ""); err == nil {
+		t.Fatal("SendPasswordReset() succeeded without an email")
+	}
+	if err := f.DeleteAccount(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+
+	req := s.received("sendOobCode")
+	if len(req) != 2 || req[0]["requestType"] != oobVerifyEmail || req[0]["idToken"] != string(c.IDToken) ||
+		req[1]["requestType"] != oobPasswordReset || req[1]["email"] != "user@example.com" || req[1]["idToken"] != nil {
+		t.Fatalf("sendOobCode requests = %v", req)
+	}
+	if req := s.received("delete"); len(req) != 1 || req[0]["idToken"] != string(c.IDToken) {
+		t.Fatalf("delete requests = %v", req)
+	}
+}
@@ -0,0 +1,175 @@
+package fireb
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// serviceAccountJSON encodes a service account key for signingKey, pkcs8
+// selects the encoding used by Google Cloud rather than PKCS #1
+func serviceAccountJSON(t *testing.T, pkcs8 bool) []byte {
+	t.Helper()
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(signingKey(t))}
+	if pkcs8 {
+		der, err := x509.MarshalPKCS8PrivateKey(signingKey(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+
+	b, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     testProjectID,
+		"private_key_id": "sa-key-1",
+		"private_key":    string(pem.EncodeToMemory(block)),
+		"client_email":   "ci-bot@" + testProjectID + ".iam.gserviceaccount.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseServiceAccount(t *testing.T) {
+	for _, pkcs8 := range []bool{false, true} {
+		sa, err := ParseServiceAccount(serviceAccountJSON(t, pkcs8))
+		if err != nil {
+			t.Fatalf("ParseServiceAccount(pkcs8 %v) = %v", pkcs8, err)
+		}
+		if sa.ProjectID != testProjectID || sa.key == nil {
+			t.Fatalf("ParseServiceAccount(pkcs8 %v) = %+v", pkcs8, sa)
+		}
+	}
+
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{name: "not JSON", key: "service_account"},
+		{name: "wrong type", key: `{"type":"authorized_user","client_email":"a","private_key":"b"}`},
+		{name: "missing key", key: `{"type":"service_account","client_email":"a"}`},
+		{name: "key not PEM", key: `{"type":"service_account","client_email":"a","private_key":"b"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseServiceAccount([]byte(tt.key)); err == nil {
+				t.Fatal("ParseServiceAccount() succeeded")
+			}
+		})
+	}
+}
+
+func TestCustomToken(t *testing.T) {
+	sa, err := ParseServiceAccount(serviceAccountJSON(t, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := sa.CustomToken("ci-bot", map[string]interface{}{"role": "ci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("custom token has %d parts", len(parts))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&signingKey(t).PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Fatalf("signature invalid: %v", err)
+	}
+
+	var header map[string]string
+	var claims map[string]interface{}
+	decode := func(s string, v interface{}) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(b, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decode(parts[0], &header)
+	decode(parts[1], &claims)
+
+	if header["alg"] != "RS256" || header["kid"] != "sa-key-1" {
+		t.Fatalf("header = %v", header)
+	}
+	if claims["iss"] != sa.ClientEmail || claims["sub"] != sa.ClientEmail || claims["aud"] != customTokenAudience || claims["uid"] != "ci-bot" {
+		t.Fatalf("claims = %v", claims)
+	}
+	if exp, iat := claims["exp"].(float64), claims["iat"].(float64); exp-iat != customTokenLifetime.Seconds() {
+		t.Fatalf("lifetime = %vs, want %v", exp-iat, customTokenLifetime)
+	}
+	if developer, _ := claims["claims"].(map[string]interface{}); developer["role"] != "ci" {
+		t.Fatalf("developer claims = %v", claims["claims"])
+	}
+}
+
+func TestCustomTokenRejectsInvalidInput(t *testing.T) {
+	sa, err := ParseServiceAccount(serviceAccountJSON(t, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		uid    string
+		claims map[string]interface{}
+	}{
+		{name: "empty uid", uid: ""},
+		{name: "long uid", uid: strings.Repeat("u", 129)},
+		{name: "reserved claim", uid: "ci-bot", claims: map[string]interface{}{"sub": "admin"}},
+		{name: "firebase claim", uid: "ci-bot", claims: map[string]interface{}{"firebase": "x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := sa.CustomToken(tt.uid, tt.claims); err == nil {
+				t.Fatal("CustomToken() succeeded")
+			}
+		})
+	}
+}
+
+func TestSignInWithCustomToken(t *testing.T) {
+	f, s := newTestFlow(t, Config{})
+	s.handle("signInWithCustomToken", func(body map[string]interface{}) (int, interface{}) {
+		resp := signInResponse(t)
+		delete(resp, "localId")
+		return http.StatusOK, resp
+	})
+
+	c, err := f.SignInWithCustomToken(context.Background(), "custom-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UID != testUID || c.RefreshToken != "refresh-token" {
+		t.Fatalf("credentials = %+v", c)
+	}
+
+	req := s.received("signInWithCustomToken")
+	if len(req) != 1 || req[0]["token"] != "custom-token" || req[0]["returnSecureToken"] != true {
+		t.Fatalf("requests = %v", req)
+	}
+
+	s.handle("signInWithCustomToken", apiError("INVALID_CUSTOM_TOKEN"))
+	if _, err := f.SignInWithCustomToken(context.Background(), "custom-token"); !errors.Is(err, ErrInvalidCustomToken) {
+		t.Fatalf("err = %v, want ErrInvalidCustomToken", err)
+	}
+}
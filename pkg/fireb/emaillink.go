@@ -0,0 +1,147 @@
+package fireb
+
+import (
+	"context"
+	"fmt"
+	"github.com/mousybusiness/authn/internal/static"
+	"github.com/mousybusiness/authn/pkg/creds"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type (
+	emailLinkRequest struct {
+		Email   string `json:"email"`
+		OOBCode string `json:"oobCode"`
+	}
+
+	// EmailLinkResponse is returned by accounts:signInWithEmailLink
+	EmailLinkResponse struct {
+		LocalID      string `json:"localId"`
+		Email        string `json:"email"`
+		IDToken      string `json:"idToken"`
+		RefreshToken string `json:"refreshToken"`
+		ExpiresIn    string `json:"expiresIn"`
+		IsNewUser    bool   `json:"isNewUser"`
+	}
+)
+
+// SendSignInLink emails a passwordless sign in link to email, which opens continueURL once
+// the user clicks it. continueURL's domain must be authorized in the Firebase console,
+// localhost is authorized by default. Complete the sign in with SignInWithEmailLink.
+func (f *firebaseFlow) SendSignInLink(ctx context.Context, email, continueURL string) error {
+	if email == "" {
+		return errors.New("require email")
+	}
+
+	if continueURL == "" {
+		return errors.New("require continueURL")
+	}
+
+	return f.post(ctx, "sendOobCode", oobRequest{
+		RequestType:        oobEmailSignIn,
+		Email:              email,
+		ContinueURL:        continueURL,
+		CanHandleCodeInApp: true,
+	}, nil)
+}
+
+// SignInWithEmailLink completes a sign in started by SendSignInLink using the
+// link from the email, e.g. pasted by a user on a headless machine. email must
+// be the address the link was sent to. Firebase errors can be matched with
+// errors.Is e.g. ErrInvalidLink or ErrExpiredLink.
+func (f *firebaseFlow) SignInWithEmailLink(ctx context.Context, email, link string) (*creds.Credentials, error) {
+	code, err := oobCode(link)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp EmailLinkResponse
+	if err := f.post(ctx, "signInWithEmailLink", emailLinkRequest{
+		Email:   email,
+		OOBCode: code,
+	}, &resp); err != nil {
+		return nil, err
+	}
+
+	if resp.IDToken == "" || resp.RefreshToken == "" {
+		return nil, errors.New("sign in response missing idToken or refreshToken")
+	}
+
+	c, err := f.newCredentials(ctx, resp.LocalID, resp.IDToken, resp.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	f.credentials = c
+	return f.credentials, nil
+}
+
+// EmailLinkAuth emails a sign in link to email which completes the sign in on
+// the redirect server when the user opens it on this machine. On headless machines
+// use SendSignInLink and have the user paste the link into SignInWithEmailLink.
+func (f *firebaseFlow) EmailLinkAuth(ctx context.Context, email string) (*creds.Credentials, error) {
+	f.reset(nil)
+
+	if err := f.serve(f.emailLinkHandler(email)); err != nil {
+		return nil, err
+	}
+
+	if err := f.SendSignInLink(ctx, email, f.redirectURL); err != nil {
+		_ = f.server.Close()
+		return nil, errors.Wrap(err, "failed to send sign in link")
+	}
+
+	fmt.Printf("A sign in link has been sent to %v, open it on this device to continue\n", email)
+	return f.wait(ctx)
+}
+
+// emailLinkHandler completes the sign in when the link from the email opens the redirect server
+func (f *firebaseFlow) emailLinkHandler(email string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		u, err := url.Parse(f.redirectURL)
+		if err != nil {
+			f.fail(w, http.StatusInternalServerError, err)
+			return
+		}
+		u.RawQuery = req.URL.RawQuery
+
+		c, err := f.SignInWithEmailLink(req.Context(), email, u.String())
+		if err != nil {
+			f.fail(w, http.StatusBadGateway, err)
+			return
+		}
+		f.credentials = c
+
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintln(w, static.SuccessHTML(f.config.Title))
+		f.server.Finish(nil)
+	}
+}
+
+// oobCode extracts the code from a sign in link, which may be nested in
+// the link or deep_link_id parameter when it passed through a Dynamic Link
+func oobCode(link string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return "", errors.Wrap(err, "invalid sign in link")
+	}
+
+	q := u.Query()
+	if code := q.Get("oobCode"); code != "" {
+		if mode := q.Get("mode"); mode != "" && mode != "signIn" {
+			return "", errors.Errorf("link is for %q rather than sign in", mode)
+		}
+		return code, nil
+	}
+
+	for _, param := range []string{"link", "deep_link_id"} {
+		if nested := q.Get(param); nested != "" {
+			return oobCode(nested)
+		}
+	}
+
+	return "", errors.New("sign in link doesn't contain an oobCode")
+}
@@ -0,0 +1,141 @@
+package fireb
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOOBCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		link    string
+		want    string
+		wantErr bool
+	}{
+		{name: "sign in link", link: "https://example.firebaseapp.com/__/auth/action?apiKey=key&mode=signIn&oobCode=code&continueUrl=x", want: "code"},
+		{name: "without mode", link: "http://localhost:63353/login/callback?oobCode=code", want: "code"},
+		{name: "pasted with whitespace", link: "  https://example.com/?oobCode=code\n", want: "code"},
+		{name: "dynamic link", link: "https://example.page.link/?link=" + url.QueryEscape("https://example.com/?mode=signIn&oobCode=nested"), want: "nested"},
+		{name: "deep link", link: "https://example.page.link/?deep_link_id=" + url.QueryEscape("https://example.com/?oobCode=deep"), want: "deep"},
+		{name: "password reset link", link: "https://example.com/?mode=resetPassword&oobCode=code", wantErr: true},
+		{name: "no code", link: "https://example.com/?mode=signIn", wantErr: true},
+		{name: "not a URL", link: "%zz", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := oobCode(tt.link)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("oobCode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("oobCode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendSignInLink(t *testing.T) {
+	f, s := newTestFlow(t, Config{})
+	s.handle("sendOobCode", func(body map[string]interface{}) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{"email": body["email"]}
+	})
+
+	if err := f.SendSignInLink(context.Background(), "user@example.com", "https://example.com/signed-in"); err != nil {
+		t.Fatal(err)
+	}
+	req := s.received("sendOobCode")[0]
+	if req["requestType"] != oobEmailSignIn || req["email"] != "user@example.com" || req["continueUrl"] != "https://example.com/signed-in" || req["canHandleCodeInApp"] != true {
+		t.Fatalf("sendOobCode request = %v", req)
+	}
+
+	if err := f.SendSignInLink(context.Background(), "", "https://example.com/signed-in"); err == nil {
+		t.Fatal("SendSignInLink() succeeded without an email")
+	}
+	if err := f.SendSignInLink(context.Background(), "user@example.com", ""); err == nil {
+		t.Fatal("SendSignInLink() succeeded without a continue URL")
+	}
+
+	s.handle("sendOobCode", apiError("UNAUTHORIZED_DOMAIN : Domain not allowlisted by project"))
+	if err := f.SendSignInLink(context.Background(), "user@example.com", "https://attacker.example.com"); !errors.Is(err, ErrUnauthorizedDomain) {
+		t.Fatalf("err = %v, want ErrUnauthorizedDomain", err)
+	}
+}
+
+func TestSignInWithEmailLink(t *testing.T) {
+	f, s := newTestFlow(t, Config{})
+	s.handle("signInWithEmailLink", func(body map[string]interface{}) (int, interface{}) {
+		return http.StatusOK, signInResponse(t)
+	})
+
+	c, err := f.SignInWithEmailLink(context.Background(), "user@example.com", "https://example.com/?mode=signIn&oobCode=code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UID != testUID || c.RefreshToken != "refresh-token" {
+		t.Fatalf("credentials = %+v", c)
+	}
+	if req := s.received("signInWithEmailLink")[0]; req["email"] != "user@example.com" || req["oobCode"] != "code" {
+		t.Fatalf("signInWithEmailLink request = %v", req)
+	}
+
+	if _, err := f.SignInWithEmailLink(context.Background(), "user@example.com", "https://example.com/"); err == nil {
+		t.Fatal("SignInWithEmailLink() succeeded without an oobCode")
+	}
+	if n := len(s.received("signInWithEmailLink")); n != 1 {
+		t.Fatalf("made %d sign in requests, want the invalid link rejected locally", n)
+	}
+
+	s.handle("signInWithEmailLink", apiError("EXPIRED_OOB_CODE"))
+	if _, err := f.SignInWithEmailLink(context.Background(), "user@example.com", "https://example.com/?oobCode=code"); !errors.Is(err, ErrExpiredLink) {
+		t.Fatalf("err = %v, want ErrExpiredLink", err)
+	}
+}
+
+func TestEmailLinkAuth(t *testing.T) {
+	f, s := newTestFlow(t, Config{RedirectServer: RedirectServer{Port: "0"}})
+	s.handle("signInWithEmailLink", func(body map[string]interface{}) (int, interface{}) {
+		if body["oobCode"] != "code" {
+			return apiError("INVALID_OOB_CODE")(body)
+		}
+		return http.StatusOK, signInResponse(t)
+	})
+
+	// the user opens the emailed link, which Firebase redirects to the continue URL
+	opened := make(chan int, 1)
+	s.handle("sendOobCode", func(body map[string]interface{}) (int, interface{}) {
+		continueURL, _ := body["continueUrl"].(string)
+		go func() {
+			resp, err := http.Get(continueURL + "?apiKey=" + testAPIKey + "&mode=signIn&oobCode=code")
+			if err != nil {
+				opened <- 0
+				return
+			}
+			_ = resp.Body.Close()
+			opened <- resp.StatusCode
+		}()
+		return http.StatusOK, map[string]interface{}{}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, err := f.EmailLinkAuth(ctx, "user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UID != testUID {
+		t.Fatalf("UID = %q, want %q", c.UID, testUID)
+	}
+	if status := <-opened; status != http.StatusOK {
+		t.Fatalf("link page status = %d, want %d", status, http.StatusOK)
+	}
+
+	req := s.received("sendOobCode")[0]
+	if req["continueUrl"] != f.redirectURL || req["email"] != "user@example.com" {
+		t.Fatalf("sendOobCode request = %v", req)
+	}
+}
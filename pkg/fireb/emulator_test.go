@@ -0,0 +1,126 @@
+package fireb
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testEmulatorHost = "localhost:9099"
+
+// setenv sets an environment variable for the duration of the test
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	prev, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(key, prev)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+}
+
+func TestEmulatorEndpoints(t *testing.T) {
+	setenv(t, emulatorHostEnv, testEmulatorHost)
+
+	f, err := New(Config{APIKey: testAPIKey, ProjectID: testProjectID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.config.EmulatorHost != testEmulatorHost {
+		t.Fatalf("EmulatorHost = %q, want it read from %v", f.config.EmulatorHost, emulatorHostEnv)
+	}
+	if f.accountsURL != "http://localhost:9099/identitytoolkit.googleapis.com/v1/accounts" {
+		t.Fatalf("accountsURL = %v", f.accountsURL)
+	}
+	if f.tokenURL != "http://localhost:9099/securetoken.googleapis.com/v1/token" {
+		t.Fatalf("tokenURL = %v", f.tokenURL)
+	}
+
+	setenv(t, emulatorHostEnv, "")
+	f, err = New(Config{APIKey: testAPIKey, ProjectID: testProjectID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.accountsURL != identityToolkitURL || f.tokenURL != refreshURL {
+		t.Fatalf("production endpoints = %v, %v", f.accountsURL, f.tokenURL)
+	}
+}
+
+func TestEmulatorAcceptsUnsignedTokensOnly(t *testing.T) {
+	unsigned, err := unsignedJWT(idTokenClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	production, _ := newTestFlow(t, Config{})
+	if _, err := production.verify(context.Background(), unsigned); err == nil {
+		t.Fatal("unsigned ID token accepted without the emulator")
+	}
+
+	emulator, _ := newTestFlow(t, Config{EmulatorHost: testEmulatorHost})
+	token, err := emulator.verify(context.Background(), unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Subject != testUID {
+		t.Fatalf("Subject = %q, want %q", token.Subject, testUID)
+	}
+
+	// the claims are still checked in emulator mode
+	claims := idTokenClaims()
+	claims["aud"] = "other-project"
+	other, _ := unsignedJWT(claims)
+	if _, err := emulator.verify(context.Background(), other); err == nil {
+		t.Fatal("emulator accepted an ID token for another project")
+	}
+}
+
+func TestSignInWithEmulatorIdP(t *testing.T) {
+	f, s := newTestFlow(t, Config{EmulatorHost: testEmulatorHost, Provider: GitHubProvider})
+	s.handle("signInWithIdp", func(body map[string]interface{}) (int, interface{}) {
+		resp := signInResponse(t)
+		resp["idToken"], _ = unsignedJWT(idTokenClaims())
+		return http.StatusOK, resp
+	})
+
+	for i := 0; i < 2; i++ {
+		c, err := f.SignInWithEmulatorIdP(context.Background(), "test@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.UID != testUID {
+			t.Fatalf("UID = %q, want %q", c.UID, testUID)
+		}
+	}
+
+	req := s.received("signInWithIdp")
+	postBody := func(i int) url.Values {
+		v, err := url.ParseQuery(req[i]["postBody"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	first, second := postBody(0), postBody(1)
+	if first.Get("providerId") != "github.com" || !strings.HasSuffix(first.Get("id_token"), ".") {
+		t.Fatalf("postBody = %v, want an unsigned github.com ID token", first)
+	}
+	if first.Get("id_token") != second.Get("id_token") {
+		t.Fatal("the same email signed in as a different fake user")
+	}
+}
+
+func TestSignInWithEmulatorIdPRequiresEmulator(t *testing.T) {
+	f, _ := newTestFlow(t, Config{})
+	if _, err := f.SignInWithEmulatorIdP(context.Background(), "test@example.com"); err == nil {
+		t.Fatal("SignInWithEmulatorIdP() succeeded without EmulatorHost")
+	}
+}
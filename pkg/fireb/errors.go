@@ -0,0 +1,122 @@
+package fireb
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// Errors returned by the Firebase Auth REST API, match them with errors.Is
+var (
+	ErrEmailExists         = errors.New("email address is already in use")
+	ErrEmailNotFound       = errors.New("no user with this email address")
+	ErrInvalidPassword     = errors.New("password is invalid")
+	ErrInvalidCredentials  = errors.New("email address or password is invalid")
+	ErrInvalidEmail        = errors.New("email address is badly formatted")
+	ErrWeakPassword        = errors.New("password is too weak")
+	ErrMissingPassword     = errors.New("password is required")
+	ErrUserDisabled        = errors.New("user account has been disabled")
+	ErrUserNotFound        = errors.New("user not found, it may have been deleted")
+	ErrOperationNotAllowed = errors.New("sign in method is disabled for this project")
+	ErrTooManyAttempts     = errors.New("too many attempts, try again later")
+	ErrTokenExpired        = errors.New("credential is no longer valid, sign in again")
+	ErrInvalidIDToken      = errors.New("ID token is invalid, sign in again")
+	ErrCredentialTooOld    = errors.New("login is too old, sign in again")
+	ErrCredentialInUse     = errors.New("credential is already linked to another user")
+	ErrNeedConfirmation    = errors.New("an account already exists with this email address using a different sign in method")
+	ErrInvalidCustomToken  = errors.New("custom token is invalid")
+	ErrCredentialMismatch  = errors.New("custom token is for a different firebase project")
+	ErrInvalidLink         = errors.New("sign in link is invalid or has already been used")
+	ErrExpiredLink         = errors.New("sign in link has expired")
+	ErrUnauthorizedDomain  = errors.New("continue URL domain isn't authorized for this project")
+	ErrInvalidAPIKey       = errors.New("API key is invalid")
+	ErrProjectNotFound     = errors.New("firebase project not found")
+)
+
+// codes maps Firebase error messages to errors
+var codes = map[string]error{
+	"EMAIL_EXISTS":                     ErrEmailExists,
+	"EMAIL_NOT_FOUND":                  ErrEmailNotFound,
+	"INVALID_PASSWORD":                 ErrInvalidPassword,
+	"INVALID_LOGIN_CREDENTIALS":        ErrInvalidCredentials,
+	"INVALID_EMAIL":                    ErrInvalidEmail,
+	"WEAK_PASSWORD":                    ErrWeakPassword,
+	"MISSING_PASSWORD":                 ErrMissingPassword,
+	"USER_DISABLED":                    ErrUserDisabled,
+	"OPERATION_NOT_ALLOWED":            ErrOperationNotAllowed,
+	"PASSWORD_LOGIN_DISABLED":          ErrOperationNotAllowed,
+	"USER_NOT_FOUND":                   ErrUserNotFound,
+	"TOO_MANY_ATTEMPTS_TRY_LATER":      ErrTooManyAttempts,
+	"RESET_PASSWORD_EXCEED_LIMIT":      ErrTooManyAttempts,
+	"TOKEN_EXPIRED":                    ErrTokenExpired,
+	"INVALID_ID_TOKEN":                 ErrInvalidIDToken,
+	"CREDENTIAL_TOO_OLD_LOGIN_AGAIN":   ErrCredentialTooOld,
+	"FEDERATED_USER_ID_ALREADY_LINKED": ErrCredentialInUse,
+	"NEED_CONFIRMATION":                ErrNeedConfirmation,
+	"INVALID_CUSTOM_TOKEN":             ErrInvalidCustomToken,
+	"CREDENTIAL_MISMATCH":              ErrCredentialMismatch,
+	"INVALID_OOB_CODE":                 ErrInvalidLink,
+	"EXPIRED_OOB_CODE":                 ErrExpiredLink,
+	"UNAUTHORIZED_DOMAIN":              ErrUnauthorizedDomain,
+	"INVALID_API_KEY":                  ErrInvalidAPIKey,
+	"PROJECT_NOT_FOUND":                ErrProjectNotFound,
+}
+
+type (
+	// Error is an error response from the Firebase Auth REST API
+	Error struct {
+		// StatusCode of the HTTP response
+		StatusCode int
+		// Code e.g. "EMAIL_NOT_FOUND"
+		Code string
+		// Message is the optional detail following the code
+		// e.g. "Password should be at least 6 characters"
+		Message string
+	}
+
+	errorResponse struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+)
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("firebase auth error %v: %v: %v", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("firebase auth error %v: %v", e.StatusCode, e.Code)
+}
+
+// Unwrap returns the error for the code so it can be matched with errors.Is
+func (e *Error) Unwrap() error {
+	return codes[e.Code]
+}
+
+// parseError parses the body of an error response, messages
+// take the form "WEAK_PASSWORD : Password should be at least 6 characters"
+func parseError(statusCode int, body []byte) error {
+	var r errorResponse
+	if err := json.Unmarshal(body, &r); err != nil || r.Error.Message == "" {
+		return &Error{StatusCode: statusCode, Code: strings.TrimSpace(string(body))}
+	}
+
+	return newError(statusCode, r.Error.Message)
+}
+
+// newError parses a Firebase error message, accounts:signInWithIdp
+// also reports some errors in the errorMessage of a 200 response
+func newError(statusCode int, message string) error {
+	parts := strings.SplitN(message, ":", 2)
+	e := &Error{
+		StatusCode: statusCode,
+		Code:       strings.TrimSpace(parts[0]),
+	}
+	if len(parts) == 2 {
+		e.Message = strings.TrimSpace(parts[1])
+	}
+
+	return e
+}
@@ -0,0 +1,174 @@
+package fireb
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/mousybusiness/authn/pkg/oidc"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testProjectID = "test-project"
+	testAPIKey    = "test-api-key"
+	testKeyID     = "key-1"
+	testUID       = "user-1"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// signingKey is generated once as every test shares securetokenKeys
+func signingKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	testKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testKey = key
+	})
+	return testKey
+}
+
+// testServer fakes the identitytoolkit and securetoken endpoints, handlers
+// are keyed by the accounts method e.g. "signInWithPassword" or "token"
+type testServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	handlers map[string]func(body map[string]interface{}) (int, interface{})
+	requests map[string][]map[string]interface{}
+}
+
+func (s *testServer) handle(method string, fn func(body map[string]interface{}) (int, interface{})) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method] = fn
+}
+
+// received returns the decoded bodies sent to method
+func (s *testServer) received(method string) []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method]
+}
+
+func (s *testServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Path[strings.LastIndexAny(r.URL.Path, ":/")+1:]
+	if r.URL.Query().Get("key") != testAPIKey {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":{"code":400,"message":"API key not valid"}}`))
+		return
+	}
+
+	b, _ := ioutil.ReadAll(r.Body)
+	body := map[string]interface{}{}
+	_ = json.Unmarshal(b, &body)
+
+	s.mu.Lock()
+	s.requests[method] = append(s.requests[method], body)
+	fn := s.handlers[method]
+	s.mu.Unlock()
+
+	if fn == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	status, resp := fn(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// newTestFlow returns a flow for testProjectID whose requests are sent to the
+// returned server and whose ID tokens are verified against signingKey
+func newTestFlow(t *testing.T, config Config) (*firebaseFlow, *testServer) {
+	t.Helper()
+	key := signingKey(t)
+
+	keys := securetokenKeys
+	securetokenKeys = oidc.StaticKeySet{{KeyID: testKeyID, Key: &key.PublicKey}}
+	t.Cleanup(func() { securetokenKeys = keys })
+
+	s := &testServer{
+		handlers: map[string]func(body map[string]interface{}) (int, interface{}){},
+		requests: map[string][]map[string]interface{}{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+
+	config.APIKey = testAPIKey
+	if config.ProjectID == "" {
+		config.ProjectID = testProjectID
+	}
+	f, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.accountsURL = s.URL + "/v1/accounts"
+	f.tokenURL = s.URL + "/v1/token"
+	return f, s
+}
+
+// idTokenClaims are valid for testProjectID and testUID
+func idTokenClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":       securetokenIssuer + testProjectID,
+		"aud":       testProjectID,
+		"sub":       testUID,
+		"iat":       now.Add(-time.Minute).Unix(),
+		"exp":       now.Add(time.Hour).Unix(),
+		"auth_time": now.Add(-time.Minute).Unix(),
+		"email":     "user@example.com",
+	}
+}
+
+// idToken signs claims with signingKey, modify changes the valid claims first
+func idToken(t *testing.T, modify func(c map[string]interface{})) string {
+	t.Helper()
+	claims := idTokenClaims()
+	if modify != nil {
+		modify(claims)
+	}
+
+	h, err := json.Marshal(map[string]string{"alg": oidc.RS256, "kid": testKeyID, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, signingKey(t), crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// signInResponse is returned by the identitytoolkit sign in methods
+func signInResponse(t *testing.T) map[string]interface{} {
+	return map[string]interface{}{
+		"localId":      testUID,
+		"email":        "user@example.com",
+		"idToken":      idToken(t, nil),
+		"refreshToken": "refresh-token",
+		"expiresIn":    "3600",
+	}
+}
@@ -16,4 +16,8 @@ type GoogleAuthResponse struct {
 	RefreshToken  string `json:"refreshToken"`
 	ExpiresIn     string `json:"expiresIn"`
 	RawUserInfo   string `json:"rawUserInfo"`
+	// ErrorMessage and NeedConfirmation report failures in a 200 response
+	// e.g. "FEDERATED_USER_ID_ALREADY_LINKED"
+	ErrorMessage     string `json:"errorMessage"`
+	NeedConfirmation bool   `json:"needConfirmation"`
 }
@@ -0,0 +1,97 @@
+package fireb
+
+import (
+	"context"
+	"github.com/mousybusiness/authn/pkg/creds"
+	"github.com/pkg/errors"
+)
+
+type (
+	anonymousRequest struct {
+		ReturnSecureToken bool `json:"returnSecureToken"`
+	}
+
+	linkPasswordRequest struct {
+		IDToken           string `json:"idToken"`
+		Email             string `json:"email"`
+		Password          string `json:"password"`
+		ReturnSecureToken bool   `json:"returnSecureToken"`
+	}
+)
+
+// SignInAnonymously creates an anonymous user e.g. for a trial. The account can
+// later be upgraded with LinkWithPassword or LinkWithProvider, keeping its UID.
+func (f *firebaseFlow) SignInAnonymously(ctx context.Context) (*creds.Credentials, error) {
+	var resp PasswordResponse
+	if err := f.post(ctx, "signUp", anonymousRequest{
+		ReturnSecureToken: true,
+	}, &resp); err != nil {
+		return nil, err
+	}
+
+	if resp.IDToken == "" || resp.RefreshToken == "" {
+		return nil, errors.New("sign in response missing idToken or refreshToken")
+	}
+
+	c, err := f.newCredentials(ctx, resp.LocalID, resp.IDToken, resp.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	f.credentials = c
+	return f.credentials, nil
+}
+
+// LinkWithPassword upgrades the user signed in with c by adding an email/password
+// credential. c.IDToken must not have expired, refresh it first if needed.
+func (f *firebaseFlow) LinkWithPassword(ctx context.Context, c *creds.Credentials, email, password string) (*creds.Credentials, error) {
+	if c == nil || c.IDToken == "" {
+		return nil, errors.New("require credentials with an IDToken to link")
+	}
+
+	var resp PasswordResponse
+	if err := f.post(ctx, "update", linkPasswordRequest{
+		IDToken:           string(c.IDToken),
+		Email:             email,
+		Password:          password,
+		ReturnSecureToken: true,
+	}, &resp); err != nil {
+		return nil, err
+	}
+
+	linkedCreds, err := f.linked(ctx, c, resp.LocalID, resp.IDToken, resp.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	f.credentials = linkedCreds
+	return f.credentials, nil
+}
+
+// LinkWithProvider upgrades the user signed in with c by running the browser
+// flow and linking the Config.Provider credential rather than signing in with it.
+// c.IDToken must not have expired, refresh it first if needed.
+func (f *firebaseFlow) LinkWithProvider(ctx context.Context, c *creds.Credentials) (*creds.Credentials, error) {
+	if c == nil || c.IDToken == "" {
+		return nil, errors.New("require credentials with an IDToken to link")
+	}
+
+	return f.auth(ctx, c)
+}
+
+// linked returns the credentials of the upgraded user, checking the UID is unchanged
+func (f *firebaseFlow) linked(ctx context.Context, c *creds.Credentials, localID, idToken, refreshToken string) (*creds.Credentials, error) {
+	if c.UID != "" && localID != c.UID {
+		return nil, errors.Errorf("linking changed the UID from %v to %v", c.UID, localID)
+	}
+
+	if idToken == "" {
+		return nil, errors.New("link response missing idToken")
+	}
+
+	if refreshToken == "" {
+		refreshToken = string(c.RefreshToken)
+	}
+
+	return f.newCredentials(ctx, localID, idToken, refreshToken)
+}
@@ -0,0 +1,169 @@
+package fireb
+
+import (
+	"context"
+	"github.com/mousybusiness/authn/pkg/creds"
+	"github.com/pkg/errors"
+	"net/http"
+	"testing"
+)
+
+// anonymous are the credentials of an anonymous testUID
+func anonymous(t *testing.T) *creds.Credentials {
+	return &creds.Credentials{
+		UID:          testUID,
+		IDToken:      creds.IDToken(idToken(t, nil)),
+		RefreshToken: "anonymous-refresh-token",
+	}
+}
+
+func TestSignInAnonymously(t *testing.T) {
+	f, s := newTestFlow(t, Config{})
+	s.handle("signUp", func(body map[string]interface{}) (int, interface{}) {
+		return http.StatusOK, signInResponse(t)
+	})
+
+	c, err := f.SignInAnonymously(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UID != testUID || c.RefreshToken != "refresh-token" {
+		t.Fatalf("credentials = %+v", c)
+	}
+
+	req := s.received("signUp")
+	if len(req) != 1 || req[0]["returnSecureToken"] != true || req[0]["email"] != nil {
+		t.Fatalf("requests = %v", req)
+	}
+}
+
+func TestLinkWithPassword(t *testing.T) {
+	tests := []struct {
+		name        string
+		response    func(t *testing.T) map[string]interface{}
+		wantRefresh creds.RefreshToken
+		wantErr     bool
+	}{
+		{
+			name:        "new refresh token",
+			response:    signInResponse,
+			wantRefresh: "refresh-token",
+		},
+		{
+			name: "refresh token omitted",
+			response: func(t *testing.T) map[string]interface{} {
+				resp := signInResponse(t)
+				delete(resp, "refreshToken")
+				return resp
+			},
+			wantRefresh: "anonymous-refresh-token",
+		},
+		{
+			name: "UID changed",
+			response: func(t *testing.T) map[string]interface{} {
+				resp := signInResponse(t)
+				resp["localId"] = "someone-else"
+				return resp
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, s := newTestFlow(t, Config{})
+			s.handle("update", func(body map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, tt.response(t)
+			})
+
+			link := anonymous(t)
+			c, err := f.LinkWithPassword(context.Background(), link, "user@example.com", "hunter22")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if c.UID != testUID || c.RefreshToken != tt.wantRefresh {
+				t.Fatalf("credentials = %+v", c)
+			}
+			req := s.received("update")
+			if req[0]["idToken"] != string(link.IDToken) || req[0]["email"] != "user@example.com" {
+				t.Fatalf("request = %v", req[0])
+			}
+		})
+	}
+}
+
+func TestLinkRequiresIDToken(t *testing.T) {
+	f, _ := newTestFlow(t, Config{})
+
+	if _, err := f.LinkWithPassword(context.Background(), &creds.Credentials{RefreshToken: "refresh"}, "user@example.com", "hunter22"); err == nil {
+		t.Fatal("LinkWithPassword() without an ID token succeeded")
+	}
+	if _, err := f.LinkWithProvider(context.Background(), nil); err == nil {
+		t.Fatal("LinkWithProvider() without credentials succeeded")
+	}
+}
+
+func TestSignInWithIdp(t *testing.T) {
+	tests := []struct {
+		name     string
+		link     bool
+		response func(t *testing.T) map[string]interface{}
+		want     error
+	}{
+		{name: "sign in", response: signInResponse},
+		{name: "link", link: true, response: signInResponse},
+		{
+			name: "already linked",
+			link: true,
+			response: func(t *testing.T) map[string]interface{} {
+				return map[string]interface{}{"errorMessage": "FEDERATED_USER_ID_ALREADY_LINKED"}
+			},
+			want: ErrCredentialInUse,
+		},
+		{
+			name: "needs confirmation",
+			response: func(t *testing.T) map[string]interface{} {
+				return map[string]interface{}{"needConfirmation": true, "email": "user@example.com"}
+			},
+			want: ErrNeedConfirmation,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, s := newTestFlow(t, Config{})
+			s.handle("signInWithIdp", func(body map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, tt.response(t)
+			})
+
+			var link *creds.Credentials
+			if tt.link {
+				link = anonymous(t)
+			}
+			f.reset(link)
+
+			c, err := f.signInWithIdp(context.Background(), LoginRequest{PostBody: "id_token=google", ReturnSecureToken: true})
+			if tt.want != nil {
+				if !errors.Is(err, tt.want) {
+					t.Fatalf("err = %v, want %v", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.UID != testUID {
+				t.Fatalf("UID = %q, want %q", c.UID, testUID)
+			}
+
+			idToken, _ := s.received("signInWithIdp")[0]["idToken"].(string)
+			if tt.link != (idToken != "") {
+				t.Fatalf("idToken sent = %v, want %v", idToken != "", tt.link)
+			}
+		})
+	}
+}
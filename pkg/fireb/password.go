@@ -0,0 +1,91 @@
+package fireb
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/mousybusiness/authn/pkg/creds"
+	"github.com/pkg/errors"
+	"golang.org/x/term"
+	"os"
+	"strings"
+)
+
+type (
+	passwordRequest struct {
+		Email             string `json:"email"`
+		Password          string `json:"password"`
+		ReturnSecureToken bool   `json:"returnSecureToken"`
+	}
+
+	// PasswordResponse is returned by accounts:signUp and accounts:signInWithPassword
+	PasswordResponse struct {
+		LocalID      string `json:"localId"`
+		Email        string `json:"email"`
+		DisplayName  string `json:"displayName"`
+		IDToken      string `json:"idToken"`
+		RefreshToken string `json:"refreshToken"`
+		ExpiresIn    string `json:"expiresIn"`
+		Registered   bool   `json:"registered"`
+	}
+)
+
+// SignUp creates a user with the email/password provider and signs them in.
+// Firebase errors can be matched with errors.Is e.g. ErrEmailExists or ErrWeakPassword.
+func (f *firebaseFlow) SignUp(ctx context.Context, email, password string) (*creds.Credentials, error) {
+	return f.passwordSignIn(ctx, "signUp", email, password)
+}
+
+// SignInWithPassword signs in a user with the email/password provider.
+// Firebase errors can be matched with errors.Is e.g. ErrEmailNotFound,
+// ErrInvalidPassword or ErrUserDisabled. Projects with email enumeration
+// protection return ErrInvalidCredentials for an unknown email or wrong password.
+func (f *firebaseFlow) SignInWithPassword(ctx context.Context, email, password string) (*creds.Credentials, error) {
+	return f.passwordSignIn(ctx, "signInWithPassword", email, password)
+}
+
+func (f *firebaseFlow) passwordSignIn(ctx context.Context, method, email, password string) (*creds.Credentials, error) {
+	var resp PasswordResponse
+	if err := f.post(ctx, method, passwordRequest{
+		Email:             email,
+		Password:          password,
+		ReturnSecureToken: true,
+	}, &resp); err != nil {
+		return nil, err
+	}
+
+	if resp.IDToken == "" || resp.RefreshToken == "" {
+		return nil, errors.New("sign in response missing idToken or refreshToken")
+	}
+
+	c, err := f.newCredentials(ctx, resp.LocalID, resp.IDToken, resp.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	f.credentials = c
+	return f.credentials, nil
+}
+
+// PromptPassword writes prompt to stderr and reads a password from stdin without
+// echoing it. When stdin isn't a terminal, e.g. a password piped from a secret
+// manager, a single line is read instead.
+func PromptPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.Wrap(err, "failed to read password")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	_, _ = fmt.Fprint(os.Stderr, prompt)
+	b, err := term.ReadPassword(fd)
+	_, _ = fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read password")
+	}
+
+	return string(b), nil
+}
@@ -0,0 +1,124 @@
+package fireb
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net/http"
+	"testing"
+)
+
+// apiError returns a Firebase Auth REST API error with message
+func apiError(message string) func(body map[string]interface{}) (int, interface{}) {
+	return func(body map[string]interface{}) (int, interface{}) {
+		return http.StatusBadRequest, map[string]interface{}{
+			"error": map[string]interface{}{"code": http.StatusBadRequest, "message": message},
+		}
+	}
+}
+
+func TestPasswordSignIn(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+	}{
+		{name: "sign up", method: "signUp"},
+		{name: "sign in", method: "signInWithPassword"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, s := newTestFlow(t, Config{})
+			s.handle(tt.method, func(body map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, signInResponse(t)
+			})
+
+			signIn := f.SignInWithPassword
+			if tt.method == "signUp" {
+				signIn = f.SignUp
+			}
+			c, err := signIn(context.Background(), "user@example.com", "hunter22")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.UID != testUID || c.RefreshToken != "refresh-token" || c.Claims["email"] != "user@example.com" {
+				t.Fatalf("credentials = %+v", c)
+			}
+
+			req := s.received(tt.method)
+			if len(req) != 1 || req[0]["email"] != "user@example.com" || req[0]["password"] != "hunter22" || req[0]["returnSecureToken"] != true {
+				t.Fatalf("requests = %v", req)
+			}
+		})
+	}
+}
+
+func TestPasswordSignInErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    error
+	}{
+		{name: "email exists", message: "EMAIL_EXISTS", want: ErrEmailExists},
+		{name: "weak password with detail", message: "WEAK_PASSWORD : Password should be at least 6 characters", want: ErrWeakPassword},
+		{name: "wrong password", message: "INVALID_PASSWORD", want: ErrInvalidPassword},
+		{name: "enumeration protection", message: "INVALID_LOGIN_CREDENTIALS", want: ErrInvalidCredentials},
+		{name: "disabled", message: "USER_DISABLED", want: ErrUserDisabled},
+		{name: "provider disabled", message: "PASSWORD_LOGIN_DISABLED", want: ErrOperationNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, s := newTestFlow(t, Config{})
+			s.handle("signInWithPassword", apiError(tt.message))
+
+			_, err := f.SignInWithPassword(context.Background(), "user@example.com", "hunter22")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+
+			var apiErr *Error
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+				t.Fatalf("err = %#v, want an *Error", err)
+			}
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want Error
+	}{
+		{name: "code", body: `{"error":{"code":400,"message":"EMAIL_NOT_FOUND"}}`, want: Error{StatusCode: 400, Code: "EMAIL_NOT_FOUND"}},
+		{name: "code and detail", body: `{"error":{"code":400,"message":"WEAK_PASSWORD : Password should be at least 6 characters"}}`, want: Error{StatusCode: 400, Code: "WEAK_PASSWORD", Message: "Password should be at least 6 characters"}},
+		{name: "not JSON", body: "Bad Gateway\n", want: Error{StatusCode: 400, Code: "Bad Gateway"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := parseError(http.StatusBadRequest, []byte(tt.body))
+			var got *Error
+			if !errors.As(err, &got) || *got != tt.want {
+				t.Fatalf("parseError() = %#v, want %#v", err, tt.want)
+			}
+		})
+	}
+
+	if err := parseError(http.StatusBadRequest, []byte(`{"error":{"message":"SOMETHING_NEW"}}`)); errors.Unwrap(err) != nil {
+		t.Fatalf("unknown code unwrapped to %v", errors.Unwrap(err))
+	}
+}
+
+func TestPasswordSignInRejectsIncompleteResponse(t *testing.T) {
+	f, s := newTestFlow(t, Config{})
+	s.handle("signInWithPassword", func(body map[string]interface{}) (int, interface{}) {
+		resp := signInResponse(t)
+		delete(resp, "refreshToken")
+		return http.StatusOK, resp
+	})
+
+	if _, err := f.SignInWithPassword(context.Background(), "user@example.com", "hunter22"); err == nil {
+		t.Fatal("SignInWithPassword() accepted a response without a refresh token")
+	}
+}
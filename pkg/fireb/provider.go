@@ -0,0 +1,144 @@
+package fireb
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// Credential is the token from the provider sent to accounts:signInWithIdp
+type Credential int
+
+const (
+	// IDTokenCredential sends the OIDC ID token as id_token
+	IDTokenCredential Credential = iota
+	// AccessTokenCredential sends the OAuth access token as access_token,
+	// for providers which don't issue ID tokens such as GitHub and Facebook
+	AccessTokenCredential
+)
+
+// Provider is an upstream identity provider federated by Firebase.
+type Provider struct {
+	// ID is the Firebase provider ID
+	// e.g. "google.com", "github.com" or "oidc.okta"
+	ID string
+	// AuthURL and TokenURL are the provider's OAuth 2.0 endpoints. When empty
+	// the flow is delegated to Firebase with accounts:createAuthUri, which is
+	// required for saml.* providers and lets oidc.* providers use the client
+	// secret stored in Firebase rather than Config.ClientSecret.
+	AuthURL  string
+	TokenURL string
+	// Scopes requested when Config.Scopes is empty
+	Scopes []string
+	// Credential sent to Firebase
+	Credential Credential
+	// Params added to the authorization request
+	Params map[string]string
+}
+
+var (
+	// GoogleProvider signs in with a Google account
+	GoogleProvider = Provider{
+		ID:       "google.com",
+		AuthURL:  "https://accounts.google.com/o/oauth2/auth",
+		TokenURL: "https://accounts.google.com/o/oauth2/token",
+		Scopes: []string{
+			"email",
+			"profile",
+			"openid",
+			"https://www.googleapis.com/auth/userinfo.email",
+			"https://www.googleapis.com/auth/userinfo.profile",
+		},
+		Credential: IDTokenCredential,
+		Params:     map[string]string{"access_type": "offline"},
+	}
+
+	// GitHubProvider signs in with a GitHub account
+	GitHubProvider = Provider{
+		ID:         "github.com",
+		AuthURL:    "https://github.com/login/oauth/authorize",
+		TokenURL:   "https://github.com/login/oauth/access_token",
+		Scopes:     []string{"read:user", "user:email"},
+		Credential: AccessTokenCredential,
+	}
+
+	// FacebookProvider signs in with a Facebook account
+	FacebookProvider = Provider{
+		ID:         "facebook.com",
+		AuthURL:    "https://www.facebook.com/v12.0/dialog/oauth",
+		TokenURL:   "https://graph.facebook.com/v12.0/oauth/access_token",
+		Scopes:     []string{"email", "public_profile"},
+		Credential: AccessTokenCredential,
+	}
+
+	// AppleProvider signs in with an Apple ID. Apple posts the callback
+	// when the name or email scopes are requested, and the client secret
+	// is a JWT signed with a key from the Apple developer portal.
+	AppleProvider = Provider{
+		ID:         "apple.com",
+		AuthURL:    "https://appleid.apple.com/auth/authorize",
+		TokenURL:   "https://appleid.apple.com/auth/token",
+		Scopes:     []string{"name", "email"},
+		Credential: IDTokenCredential,
+		Params:     map[string]string{"response_mode": "form_post"},
+	}
+)
+
+// MicrosoftProvider signs in with a Microsoft account, tenant is
+// "common", "organizations", "consumers" or an Azure AD tenant ID.
+func MicrosoftProvider(tenant string) Provider {
+	if tenant == "" {
+		tenant = "common"
+	}
+
+	return Provider{
+		ID:         "microsoft.com",
+		AuthURL:    fmt.Sprintf("https://login.microsoftonline.com/%v/oauth2/v2.0/authorize", tenant),
+		TokenURL:   fmt.Sprintf("https://login.microsoftonline.com/%v/oauth2/v2.0/token", tenant),
+		Scopes:     []string{"openid", "email", "profile"},
+		Credential: IDTokenCredential,
+	}
+}
+
+// OIDCProvider signs in with an OpenID Connect provider configured in
+// Identity Platform, id must start with "oidc." e.g. "oidc.okta".
+// The endpoints are optional, without them the flow is delegated to Firebase.
+func OIDCProvider(id, authURL, tokenURL string) Provider {
+	return Provider{
+		ID:         id,
+		AuthURL:    authURL,
+		TokenURL:   tokenURL,
+		Scopes:     []string{"openid", "email", "profile"},
+		Credential: IDTokenCredential,
+	}
+}
+
+// SAMLProvider signs in with a SAML provider configured in Identity Platform,
+// id must start with "saml." e.g. "saml.okta". The provider's ACS URL must
+// be the RedirectURL as the IdP posts the SAML response to it.
+func SAMLProvider(id string) Provider {
+	return Provider{
+		ID: id,
+	}
+}
+
+// delegated reports whether Firebase runs the flow using accounts:createAuthUri
+func (p Provider) delegated() bool {
+	return p.AuthURL == ""
+}
+
+func (p Provider) validate() error {
+	if p.ID == "" {
+		return errors.New("require Provider.ID")
+	}
+
+	if strings.HasPrefix(p.ID, "saml.") && !p.delegated() {
+		return errors.New("saml providers can't set AuthURL, the flow is delegated to Firebase")
+	}
+
+	if !p.delegated() && p.TokenURL == "" {
+		return errors.New("require Provider.TokenURL with AuthURL")
+	}
+
+	return nil
+}
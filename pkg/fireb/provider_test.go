@@ -0,0 +1,185 @@
+package fireb
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProviderValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider Provider
+		wantErr  bool
+	}{
+		{name: "default google", provider: Provider{}},
+		{name: "github", provider: GitHubProvider},
+		{name: "microsoft", provider: MicrosoftProvider("")},
+		{name: "delegated oidc", provider: OIDCProvider("oidc.okta", "", "")},
+		{name: "saml", provider: SAMLProvider("saml.okta")},
+		{name: "saml with endpoints", provider: Provider{ID: "saml.okta", AuthURL: "https://idp.example.com/auth", TokenURL: "https://idp.example.com/token"}, wantErr: true},
+		{name: "auth without token url", provider: OIDCProvider("oidc.okta", "https://idp.example.com/auth", ""), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(Config{APIKey: testAPIKey, ProjectID: testProjectID, Provider: tt.provider})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	f, _ := newTestFlow(t, Config{ClientID: "client", Provider: GitHubProvider, LoginHint: "octocat"})
+
+	u, err := url.Parse(f.authCodeURL("state", "http://localhost:1234/login/callback"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if !strings.HasPrefix(u.String(), GitHubProvider.AuthURL+"?") || q.Get("client_id") != "client" || q.Get("scope") != "read:user user:email" ||
+		q.Get("state") != "state" || q.Get("response_type") != "code" || q.Get("login_hint") != "octocat" {
+		t.Fatalf("authCodeURL() = %v", u)
+	}
+
+	f, _ = newTestFlow(t, Config{ClientID: "client"})
+	u, _ = url.Parse(f.authCodeURL("state", "http://localhost:1234/login/callback"))
+	if u.Query().Get("access_type") != "offline" {
+		t.Fatalf("Google authCodeURL() = %v, want the provider's params", u)
+	}
+}
+
+// serveCallback starts the redirect server for f as Auth does without
+// opening the browser, sends req to it and waits for the flow to finish
+func serveCallback(t *testing.T, f *firebaseFlow, send func(redirectURL string) (*http.Response, error)) (int, error) {
+	t.Helper()
+	f.reset(nil)
+	if err := f.serve(f.redirectHandler); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = f.server.Close() })
+
+	resp, err := send(f.redirectURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	_, err = f.wait(ctx)
+	return resp.StatusCode, err
+}
+
+func TestRedirectCallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider Provider
+		query    func(f *firebaseFlow) url.Values
+		status   int
+		postBody string // sent to signInWithIdp, empty if not signed in
+		err      error
+	}{
+		{
+			name:     "access token credential",
+			provider: GitHubProvider,
+			query:    func(f *firebaseFlow) url.Values { return url.Values{"state": {f.state}, "code": {"code"}} },
+			status:   http.StatusOK,
+			postBody: "access_token=provider-access&providerId=github.com",
+		},
+		{
+			name:     "id token credential",
+			provider: OIDCProvider("oidc.okta", "https://idp.example.com/auth", ""),
+			query:    func(f *firebaseFlow) url.Values { return url.Values{"state": {f.state}, "code": {"code"}} },
+			status:   http.StatusOK,
+			postBody: "id_token=provider-id&providerId=oidc.okta",
+		},
+		{
+			name:     "state mismatch",
+			provider: GitHubProvider,
+			query:    func(f *firebaseFlow) url.Values { return url.Values{"state": {"attacker"}, "code": {"code"}} },
+			status:   http.StatusBadRequest,
+			err:      ErrStateMismatch,
+		},
+		{
+			name:     "provider error",
+			provider: GitHubProvider,
+			query:    func(f *firebaseFlow) url.Values { return url.Values{"state": {f.state}, "error": {"access_denied"}} },
+			status:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, s := newTestFlow(t, Config{RedirectServer: RedirectServer{Port: "0"}, ClientID: "client", ClientSecret: "secret"})
+			s.handle("exchange", func(body map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, map[string]string{"access_token": "provider-access", "id_token": "provider-id"}
+			})
+			s.handle("signInWithIdp", func(body map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, signInResponse(t)
+			})
+			f.config.Provider = tt.provider
+			f.config.Provider.TokenURL = s.URL + "/oauth/exchange?key=" + testAPIKey
+
+			status, err := serveCallback(t, f, func(redirectURL string) (*http.Response, error) {
+				return http.Get(redirectURL + "?" + tt.query(f).Encode())
+			})
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+
+			req := s.received("signInWithIdp")
+			if tt.postBody == "" {
+				if err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				if len(req) != 0 {
+					t.Fatal("signed in for a rejected callback")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(req) != 1 || req[0]["postBody"] != tt.postBody {
+				t.Fatalf("signInWithIdp requests = %v", req)
+			}
+		})
+	}
+}
+
+func TestDelegatedProvider(t *testing.T) {
+	f, s := newTestFlow(t, Config{RedirectServer: RedirectServer{Port: "0"}, Provider: SAMLProvider("saml.okta")})
+	s.handle("createAuthUri", func(body map[string]interface{}) (int, interface{}) {
+		return http.StatusOK, map[string]string{"authUri": "https://idp.example.com/sso", "sessionId": "session"}
+	})
+	s.handle("signInWithIdp", func(body map[string]interface{}) (int, interface{}) {
+		return http.StatusOK, signInResponse(t)
+	})
+
+	status, err := serveCallback(t, f, func(redirectURL string) (*http.Response, error) {
+		uri, err := f.authorizationURL(context.Background())
+		if err != nil || uri != "https://idp.example.com/sso" {
+			t.Fatalf("authorizationURL() = %v, %v", uri, err)
+		}
+		return http.PostForm(redirectURL, url.Values{"SAMLResponse": {"assertion"}, "RelayState": {"firebase"}})
+	})
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("callback = %d, %v", status, err)
+	}
+
+	create := s.received("createAuthUri")[0]
+	if create["providerId"] != "saml.okta" || create["continueUri"] != f.redirectURL {
+		t.Fatalf("createAuthUri request = %v", create)
+	}
+	req := s.received("signInWithIdp")[0]
+	if req["sessionId"] != "session" || req["requestUri"] != f.redirectURL || req["postBody"] != "RelayState=firebase&SAMLResponse=assertion" {
+		t.Fatalf("signInWithIdp request = %v", req)
+	}
+}
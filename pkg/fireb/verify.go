@@ -0,0 +1,83 @@
+package fireb
+
+import (
+	"context"
+	"github.com/mousybusiness/authn/pkg/creds"
+	"github.com/mousybusiness/authn/pkg/oidc"
+	"github.com/pkg/errors"
+	"time"
+)
+
+const (
+	securetokenIssuer   = "https://securetoken.google.com/"
+	securetokenCertsURL = "https://www.googleapis.com/robot/v1/metadata/x509/securetoken@system.gserviceaccount.com"
+	// maxUIDLength is the longest UID Firebase issues
+	maxUIDLength = 128
+	// expiryBuffer refreshes credentials shortly before the ID token expires
+	expiryBuffer = time.Minute
+)
+
+// securetokenKeys is shared by every flow so the certificates are
+// only fetched again when the Cache-Control max-age has passed
+var securetokenKeys oidc.KeySet = oidc.NewX509KeySet(securetokenCertsURL)
+
+// newVerifier checks ID tokens were issued by Firebase Auth for projectID as described in
+// https://firebase.google.com/docs/auth/admin/verify-id-tokens#verify_id_tokens_using_a_third-party_jwt_library,
+// the Auth emulator's tokens are unsigned so only their claims are checked
+func newVerifier(projectID string, emulator bool) (*oidc.Verifier, error) {
+	return oidc.NewVerifier(oidc.VerifierConfig{
+		Issuer:                     securetokenIssuer + projectID,
+		ClientID:                   projectID,
+		KeySet:                     securetokenKeys,
+		Algorithms:                 []string{oidc.RS256},
+		RequiredClaims:             []string{"auth_time"},
+		Checks:                     []func(*oidc.IDToken) error{checkFirebaseClaims},
+		InsecureSkipSignatureCheck: emulator,
+	})
+}
+
+func checkFirebaseClaims(t *oidc.IDToken) error {
+	if len(t.Subject) > maxUIDLength {
+		return errors.New("ID token subject is too long")
+	}
+
+	if t.AuthTime.After(time.Now().Add(expiryBuffer)) {
+		return errors.New("ID token auth_time is in the future")
+	}
+	return nil
+}
+
+// verify checks idToken was issued by Firebase Auth for Config.ProjectID
+func (f *firebaseFlow) verify(ctx context.Context, idToken string) (*oidc.IDToken, error) {
+	t, err := f.verifier.Verify(ctx, idToken, oidc.Expected{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to verify ID token")
+	}
+	return t, nil
+}
+
+// newCredentials verifies idToken and creates credentials from it, localID is
+// the UID returned alongside the token and must match its subject when set
+func (f *firebaseFlow) newCredentials(ctx context.Context, localID, idToken, refreshToken string) (*creds.Credentials, error) {
+	t, err := f.verify(ctx, idToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return credentials(t, localID, refreshToken)
+}
+
+// credentials are created from a verified ID token
+func credentials(t *oidc.IDToken, localID, refreshToken string) (*creds.Credentials, error) {
+	if localID != "" && localID != t.Subject {
+		return nil, errors.Errorf("ID token subject %v doesn't match UID %v", t.Subject, localID)
+	}
+
+	return &creds.Credentials{
+		UID:          t.Subject,
+		IDToken:      creds.IDToken(t.Raw),
+		RefreshToken: creds.RefreshToken(refreshToken),
+		Expiry:       t.Expiry.Add(-expiryBuffer),
+		Claims:       t.Claims,
+	}, nil
+}
@@ -0,0 +1,188 @@
+package fireb
+
+import (
+	"context"
+	"github.com/mousybusiness/authn/pkg/creds"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewRequiresProjectID(t *testing.T) {
+	env, ok := os.LookupEnv(projectIDEnv)
+	defer func() {
+		if ok {
+			_ = os.Setenv(projectIDEnv, env)
+		} else {
+			_ = os.Unsetenv(projectIDEnv)
+		}
+	}()
+
+	_ = os.Unsetenv(projectIDEnv)
+	if _, err := New(Config{APIKey: testAPIKey}); err == nil {
+		t.Fatal("New() succeeded without a ProjectID")
+	}
+
+	_ = os.Setenv(projectIDEnv, testProjectID)
+	f, err := New(Config{APIKey: testAPIKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.config.ProjectID != testProjectID {
+		t.Fatalf("ProjectID = %q, want %q", f.config.ProjectID, testProjectID)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	f, _ := newTestFlow(t, Config{})
+
+	tests := []struct {
+		name   string
+		claims func(c map[string]interface{})
+		token  string
+		wantOK bool
+	}{
+		{
+			name:   "valid",
+			wantOK: true,
+		},
+		{
+			name: "another project",
+			claims: func(c map[string]interface{}) {
+				c["aud"] = "other-project"
+				c["iss"] = securetokenIssuer + "other-project"
+			},
+		},
+		{
+			name:   "wrong audience",
+			claims: func(c map[string]interface{}) { c["aud"] = "other-project" },
+		},
+		{
+			name:   "wrong issuer",
+			claims: func(c map[string]interface{}) { c["iss"] = securetokenIssuer + "other-project" },
+		},
+		{
+			name:   "expired",
+			claims: func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		},
+		{
+			name:   "missing auth_time",
+			claims: func(c map[string]interface{}) { delete(c, "auth_time") },
+		},
+		{
+			name:   "auth_time in the future",
+			claims: func(c map[string]interface{}) { c["auth_time"] = time.Now().Add(time.Hour).Unix() },
+		},
+		{
+			name:   "subject too long",
+			claims: func(c map[string]interface{}) { c["sub"] = strings.Repeat("a", maxUIDLength+1) },
+		},
+		{
+			name:  "unsigned",
+			token: "eyJhbGciOiJub25lIn0." + strings.Split(idToken(t, nil), ".")[1] + ".",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := tt.token
+			if token == "" {
+				token = idToken(t, tt.claims)
+			}
+
+			c, err := f.newCredentials(context.Background(), testUID, token, "refresh-token")
+			if !tt.wantOK {
+				if err == nil {
+					t.Fatal("newCredentials() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newCredentials() error = %v", err)
+			}
+			if c.UID != testUID || c.RefreshToken != "refresh-token" || c.Claims["email"] != "user@example.com" {
+				t.Fatalf("newCredentials() = %+v", c)
+			}
+			if c.Expiry.IsZero() || !c.Expiry.Before(time.Now().Add(time.Hour)) {
+				t.Fatalf("Expiry = %v, want before the token expires", c.Expiry)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsMismatchedUID(t *testing.T) {
+	f, _ := newTestFlow(t, Config{})
+	if _, err := f.newCredentials(context.Background(), "other-user", idToken(t, nil), "refresh-token"); err == nil {
+		t.Fatal("newCredentials() accepted a token for another UID")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	tests := []struct {
+		name   string
+		resp   func(t *testing.T) map[string]interface{}
+		wantOK bool
+	}{
+		{
+			name: "verified against ProjectID rather than the project number",
+			resp: func(t *testing.T) map[string]interface{} {
+				return map[string]interface{}{
+					"id_token":   idToken(t, nil),
+					"user_id":    testUID,
+					"project_id": "123456789012",
+					"expires_in": "3600",
+				}
+			},
+			wantOK: true,
+		},
+		{
+			name: "token for another project",
+			resp: func(t *testing.T) map[string]interface{} {
+				return map[string]interface{}{
+					"id_token": idToken(t, func(c map[string]interface{}) {
+						c["aud"] = "other-project"
+						c["iss"] = securetokenIssuer + "other-project"
+					}),
+					"user_id":    testUID,
+					"project_id": "other-project",
+				}
+			},
+		},
+		{
+			name: "missing ID token",
+			resp: func(t *testing.T) map[string]interface{} {
+				return map[string]interface{}{"user_id": testUID}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, s := newTestFlow(t, Config{})
+			s.handle("token", func(body map[string]interface{}) (int, interface{}) {
+				return 200, tt.resp(t)
+			})
+
+			c, err := f.Refresh(context.Background(), creds.RefreshToken("refresh-token"))
+			if !tt.wantOK {
+				if err == nil {
+					t.Fatal("Refresh() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Refresh() error = %v", err)
+			}
+			// the refresh token is kept when the response doesn't rotate it
+			if c.UID != testUID || c.RefreshToken != "refresh-token" || c.Claims["email"] != "user@example.com" {
+				t.Fatalf("Refresh() = %+v", c)
+			}
+
+			req := s.received("token")
+			if len(req) != 1 || req[0]["refresh_token"] != "refresh-token" || req[0]["grant_type"] != "refresh_token" {
+				t.Fatalf("refresh request = %v", req)
+			}
+		})
+	}
+}
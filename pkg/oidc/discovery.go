@@ -0,0 +1,150 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/mousybusiness/authn/internal/errs"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wellKnownPath = "/.well-known/openid-configuration"
+	defaultTTL    = time.Hour
+)
+
+// DefaultDiscovery is used by Discover and caches documents for an hour.
+var DefaultDiscovery = NewDiscovery(defaultTTL)
+
+type (
+	// Metadata is the OpenID Provider configuration document
+	// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+	Metadata struct {
+		Issuer                           string   `json:"issuer"`
+		AuthorizationEndpoint            string   `json:"authorization_endpoint"`
+		TokenEndpoint                    string   `json:"token_endpoint"`
+		UserinfoEndpoint                 string   `json:"userinfo_endpoint"`
+		RevocationEndpoint               string   `json:"revocation_endpoint"`
+		EndSessionEndpoint               string   `json:"end_session_endpoint"`
+		DeviceAuthorizationEndpoint      string   `json:"device_authorization_endpoint"`
+		JWKSURI                          string   `json:"jwks_uri"`
+		ScopesSupported                  []string `json:"scopes_supported"`
+		ResponseTypesSupported           []string `json:"response_types_supported"`
+		CodeChallengeMethodsSupported    []string `json:"code_challenge_methods_supported"`
+		IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+		ClaimsSupported                  []string `json:"claims_supported"`
+	}
+
+	// Discovery fetches and caches provider metadata, it is safe for concurrent use.
+	Discovery struct {
+		ttl    time.Duration
+		client *http.Client
+
+		mu   sync.Mutex
+		docs map[string]discoveryEntry
+	}
+
+	discoveryEntry struct {
+		metadata *Metadata
+		expires  time.Time
+	}
+)
+
+// NewDiscovery caches metadata documents for ttl.
+func NewDiscovery(ttl time.Duration) *Discovery {
+	return &Discovery{
+		ttl:    ttl,
+		client: http.DefaultClient,
+		docs:   map[string]discoveryEntry{},
+	}
+}
+
+// Discover returns the metadata for issuer using DefaultDiscovery.
+func Discover(ctx context.Context, issuer string) (*Metadata, error) {
+	return DefaultDiscovery.Metadata(ctx, issuer)
+}
+
+// Metadata returns the cached metadata for issuer, fetching
+// /.well-known/openid-configuration if missing or expired.
+// The issuer in the document must match the requested issuer.
+func (d *Discovery) Metadata(ctx context.Context, issuer string) (*Metadata, error) {
+	if issuer == "" {
+		return nil, errors.New("require issuer")
+	}
+
+	d.mu.Lock()
+	e, ok := d.docs[issuer]
+	d.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		m := *e.metadata
+		return &m, nil
+	}
+
+	m, err := d.fetch(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.docs[issuer] = discoveryEntry{
+		metadata: m,
+		expires:  time.Now().Add(d.ttl),
+	}
+	d.mu.Unlock()
+
+	c := *m
+	return &c, nil
+}
+
+// Invalidate removes issuer from the cache so it is fetched again.
+func (d *Discovery) Invalidate(issuer string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.docs, issuer)
+}
+
+func (d *Discovery) fetch(ctx context.Context, issuer string) (*Metadata, error) {
+	uri := strings.TrimSuffix(issuer, "/") + wellKnownPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch provider metadata")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errs.NewHttpError(resp.StatusCode, fmt.Sprintf("error response from %v", uri))
+	}
+
+	var m Metadata
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, errors.Wrap(err, "failed to parse provider metadata")
+	}
+
+	// must be identical, OpenID Connect Discovery section 4.3, as the verifier compares
+	// iss exactly and it prevents an endpoint impersonating another issuer
+	if m.Issuer != issuer {
+		return nil, errors.Errorf("issuer mismatch, expected %q but metadata contains %q", issuer, m.Issuer)
+	}
+
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, errors.New("provider metadata missing authorization_endpoint, token_endpoint or jwks_uri")
+	}
+
+	return &m, nil
+}
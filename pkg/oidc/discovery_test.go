@@ -0,0 +1,164 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newDiscoveryServer serves a metadata document for the issuer path,
+// modify changes the valid document before it's served
+func newDiscoveryServer(t *testing.T, path string, modify func(issuer string, m map[string]interface{})) (*httptest.Server, *int32) {
+	t.Helper()
+	var fetches int32
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path+wellKnownPath {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+
+		issuer := s.URL + path
+		m := map[string]interface{}{
+			"issuer":                 issuer,
+			"authorization_endpoint": issuer + "/v1/authorize",
+			"token_endpoint":         issuer + "/v1/token",
+			"jwks_uri":               issuer + "/v1/keys",
+			"revocation_endpoint":    issuer + "/v1/revoke",
+		}
+		if modify != nil {
+			modify(issuer, m)
+		}
+		_ = json.NewEncoder(w).Encode(m)
+	}))
+	t.Cleanup(s.Close)
+	return s, &fetches
+}
+
+func TestDiscovery(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		suffix string // appended to the issuer requested
+		modify func(issuer string, m map[string]interface{})
+		wantOK bool
+	}{
+		{
+			name:   "valid",
+			wantOK: true,
+		},
+		{
+			name:   "issuer with a path",
+			path:   "/oauth2/default",
+			wantOK: true,
+		},
+		{
+			name:   "issuer with a trailing slash",
+			path:   "/oauth2/default",
+			suffix: "/",
+			modify: func(issuer string, m map[string]interface{}) { m["issuer"] = issuer + "/" },
+			wantOK: true,
+		},
+		{
+			name:   "another issuer",
+			modify: func(issuer string, m map[string]interface{}) { m["issuer"] = "https://attacker.example.com" },
+		},
+		{
+			name:   "document adds a trailing slash",
+			modify: func(issuer string, m map[string]interface{}) { m["issuer"] = issuer + "/" },
+		},
+		{
+			name:   "document drops the trailing slash",
+			path:   "/oauth2/default",
+			suffix: "/",
+		},
+		{
+			name:   "missing token endpoint",
+			modify: func(issuer string, m map[string]interface{}) { delete(m, "token_endpoint") },
+		},
+		{
+			name:   "missing jwks_uri",
+			modify: func(issuer string, m map[string]interface{}) { delete(m, "jwks_uri") },
+		},
+		{
+			name:   "not found",
+			path:   "/oauth2/default",
+			suffix: "/missing",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newDiscoveryServer(t, tt.path, tt.modify)
+			issuer := s.URL + tt.path + tt.suffix
+
+			m, err := NewDiscovery(time.Hour).Metadata(context.Background(), issuer)
+			if !tt.wantOK {
+				if err == nil {
+					t.Fatalf("Metadata() = %+v, want an error", m)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Issuer != issuer || m.TokenEndpoint != s.URL+tt.path+"/v1/token" || m.RevocationEndpoint == "" {
+				t.Fatalf("Metadata() = %+v", m)
+			}
+		})
+	}
+}
+
+func TestDiscoveryCaches(t *testing.T) {
+	s, fetches := newDiscoveryServer(t, "", nil)
+	d := NewDiscovery(time.Hour)
+
+	for i := 0; i < 3; i++ {
+		m, err := d.Metadata(context.Background(), s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// callers get copies of the cached document
+		m.TokenEndpoint = "modified"
+	}
+	if n := atomic.LoadInt32(fetches); n != 1 {
+		t.Fatalf("fetched %d times, want 1", n)
+	}
+
+	m, err := d.Metadata(context.Background(), s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.TokenEndpoint == "modified" {
+		t.Fatal("cached metadata was modified by a caller")
+	}
+
+	d.Invalidate(s.URL)
+	if _, err := d.Metadata(context.Background(), s.URL); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(fetches); n != 2 {
+		t.Fatalf("fetched %d times after Invalidate, want 2", n)
+	}
+}
+
+func TestDiscoveryExpires(t *testing.T) {
+	s, fetches := newDiscoveryServer(t, "", nil)
+	d := NewDiscovery(time.Millisecond * 10)
+
+	if _, err := d.Metadata(context.Background(), s.URL); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 20)
+	if _, err := d.Metadata(context.Background(), s.URL); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(fetches); n != 2 {
+		t.Fatalf("fetched %d times, want 2", n)
+	}
+}
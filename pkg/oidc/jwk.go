@@ -0,0 +1,178 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"math/big"
+)
+
+type (
+	// JSONWebKey is a parsed public key from a JWKS
+	JSONWebKey struct {
+		KeyID     string
+		Algorithm string // optional, restricts the key to a single algorithm
+		Key       crypto.PublicKey
+	}
+
+	// rawJWKS is the JSON Web Key Set document, RFC 7517 section 5
+	rawJWKS struct {
+		Keys []rawJWK `json:"keys"`
+	}
+
+	rawJWK struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		// RSA
+		N string `json:"n"`
+		E string `json:"e"`
+		// EC and OKP
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+)
+
+// ParseJWKS parses a JSON Web Key Set, skipping keys which are invalid,
+// aren't used for signatures or whose type isn't supported.
+func ParseJWKS(b []byte) ([]JSONWebKey, error) {
+	var set rawJWKS
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, errors.Wrap(err, "failed to parse JWKS")
+	}
+
+	keys := make([]JSONWebKey, 0, len(set.Keys))
+	for _, raw := range set.Keys {
+		if raw.Use != "" && raw.Use != "sig" {
+			continue
+		}
+
+		key, err := raw.publicKey()
+		if err != nil {
+			log.Warn(errors.Wrapf(err, "skipping invalid key %q", raw.Kid))
+			continue
+		}
+		if key == nil {
+			continue
+		}
+
+		keys = append(keys, JSONWebKey{
+			KeyID:     raw.Kid,
+			Algorithm: raw.Alg,
+			Key:       key,
+		})
+	}
+
+	return keys, nil
+}
+
+// ParseX509Certs parses a JSON object mapping key IDs to PEM encoded
+// certificates, skipping certificates which are invalid.
+func ParseX509Certs(b []byte) ([]JSONWebKey, error) {
+	var certs map[string]string
+	if err := json.Unmarshal(b, &certs); err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificates")
+	}
+
+	keys := make([]JSONWebKey, 0, len(certs))
+	for kid, data := range certs {
+		block, _ := pem.Decode([]byte(data))
+		if block == nil {
+			log.Warnf("skipping certificate %q which isn't PEM encoded", kid)
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			log.Warn(errors.Wrapf(err, "skipping invalid certificate %q", kid))
+			continue
+		}
+
+		keys = append(keys, JSONWebKey{
+			KeyID: kid,
+			Key:   cert.PublicKey,
+		})
+	}
+
+	return keys, nil
+}
+
+// publicKey returns nil for unsupported key types
+func (j rawJWK) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, errors.New("missing key parameter")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
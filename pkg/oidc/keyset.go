@@ -0,0 +1,277 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"github.com/mousybusiness/authn/internal/errs"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultKeysTTL is used when the JWKS response has no Cache-Control max-age
+	defaultKeysTTL = time.Hour
+	// minKeysTTL stops a no-cache response causing a fetch per verification
+	minKeysTTL = time.Minute
+	// maxKeysTTL ensures revoked keys are eventually dropped
+	maxKeysTTL = time.Hour * 24
+	// minRefetchInterval rate limits fetches triggered by unknown key IDs
+	// and retries after the endpoint failed
+	minRefetchInterval = time.Second * 30
+	// fetchTimeout bounds a fetch, which is shared by every waiting verification
+	fetchTimeout = time.Second * 30
+)
+
+var (
+	sharedKeySetsMu sync.Mutex
+	sharedKeySets   = map[string]*RemoteKeySet{}
+)
+
+type (
+	// KeySet provides the public keys used to verify token signatures.
+	KeySet interface {
+		// Keys returns the keys matching kid, or every key when kid is empty
+		Keys(ctx context.Context, kid string) ([]JSONWebKey, error)
+	}
+
+	// StaticKeySet is a fixed set of keys, useful for testing or pinned keys.
+	StaticKeySet []JSONWebKey
+
+	// RemoteKeySet fetches keys from the issuer's JWKS endpoint and caches them
+	// according to the response's Cache-Control header. Unknown key IDs trigger a
+	// rate limited refetch to pick up rotated keys, and cached keys continue to be
+	// served if the endpoint is temporarily unavailable. It is safe for concurrent use,
+	// cached keys are served while a fetch is in flight and concurrent fetches are shared.
+	RemoteKeySet struct {
+		issuer  string
+		jwksURL string
+		parse   func([]byte) ([]JSONWebKey, error)
+
+		mu        sync.Mutex
+		keys      []JSONWebKey
+		expires   time.Time
+		lastFetch time.Time
+		failed    time.Time // when the last fetch failed
+		err       error     // of the last fetch
+		inflight  *keysFetch
+	}
+
+	// keysFetch is shared by every caller waiting on the same fetch
+	keysFetch struct {
+		done chan struct{}
+		keys []JSONWebKey
+		err  error
+	}
+)
+
+func (s StaticKeySet) Keys(ctx context.Context, kid string) ([]JSONWebKey, error) {
+	return filterKeys(s, kid), nil
+}
+
+// NewRemoteKeySet fetches keys for issuer from jwksURL, if jwksURL
+// is empty it is resolved using discovery.
+func NewRemoteKeySet(issuer, jwksURL string) *RemoteKeySet {
+	return &RemoteKeySet{
+		issuer:  issuer,
+		jwksURL: jwksURL,
+		parse:   ParseJWKS,
+	}
+}
+
+// NewX509KeySet fetches keys from certsURL, a JSON object mapping key IDs
+// to PEM encoded certificates such as Google's securetoken certificates.
+func NewX509KeySet(certsURL string) *RemoteKeySet {
+	return &RemoteKeySet{
+		jwksURL: certsURL,
+		parse:   ParseX509Certs,
+	}
+}
+
+// SharedKeySet returns the process wide RemoteKeySet for issuer so every
+// verifier for the same issuer shares one cache. jwksURL is only used
+// when the key set is first created.
+func SharedKeySet(issuer, jwksURL string) *RemoteKeySet {
+	sharedKeySetsMu.Lock()
+	defer sharedKeySetsMu.Unlock()
+
+	r, ok := sharedKeySets[issuer]
+	if !ok {
+		r = NewRemoteKeySet(issuer, jwksURL)
+		sharedKeySets[issuer] = r
+	}
+	return r
+}
+
+func (r *RemoteKeySet) Keys(ctx context.Context, kid string) ([]JSONWebKey, error) {
+	r.mu.Lock()
+	now := time.Now()
+	matched := filterKeys(r.keys, kid)
+	hit := r.keys != nil && (len(matched) > 0 || kid == "")
+	switch {
+	case hit && now.Before(r.expires):
+		r.mu.Unlock()
+		return matched, nil
+	case hit:
+		// serve the stale keys rather than waiting for them to be refreshed
+		if r.inflight == nil && now.Sub(r.lastFetch) >= minRefetchInterval {
+			r.start(now)
+		}
+		r.mu.Unlock()
+		return matched, nil
+	case r.keys != nil && r.inflight == nil && now.Sub(r.lastFetch) < minRefetchInterval:
+		// an unknown kid usually means the keys were rotated, refetches are rate limited
+		r.mu.Unlock()
+		return nil, nil
+	case r.keys == nil && r.inflight == nil && now.Sub(r.failed) < minRefetchInterval:
+		// without cached keys every verification would otherwise retry the failing endpoint
+		err := r.err
+		r.mu.Unlock()
+		return nil, err
+	}
+
+	call := r.inflight
+	if call == nil {
+		call = r.start(now)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-call.done:
+	}
+
+	if call.err != nil {
+		r.mu.Lock()
+		keys := r.keys
+		r.mu.Unlock()
+
+		if keys == nil {
+			return nil, call.err
+		}
+		return filterKeys(keys, kid), nil
+	}
+
+	return filterKeys(call.keys, kid), nil
+}
+
+// start begins a fetch, it must be called with mu held
+func (r *RemoteKeySet) start(now time.Time) *keysFetch {
+	call := &keysFetch{
+		done: make(chan struct{}),
+	}
+	r.inflight = call
+	r.lastFetch = now
+	go r.run(call)
+	return call
+}
+
+// run fetches the keys without holding mu, on a context detached from
+// the callers so cancelling one doesn't fail the others, then publishes them
+func (r *RemoteKeySet) run(call *keysFetch) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+
+	keys, ttl, err := r.fetch(ctx)
+
+	r.mu.Lock()
+	r.err = err
+	if err == nil {
+		r.keys = keys
+		r.expires = time.Now().Add(ttl)
+	} else {
+		r.failed = time.Now()
+		if r.keys != nil {
+			log.Warn(errors.Wrap(err, "failed to refresh keys, using cached keys"))
+		}
+	}
+	r.inflight = nil
+	r.mu.Unlock()
+
+	call.keys, call.err = keys, err
+	close(call.done)
+}
+
+func (r *RemoteKeySet) fetch(ctx context.Context) ([]JSONWebKey, time.Duration, error) {
+	uri := r.jwksURL
+	if uri == "" {
+		m, err := Discover(ctx, r.issuer)
+		if err != nil {
+			return nil, 0, err
+		}
+		uri = m.JWKSURI
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to fetch keys")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errs.NewHttpError(resp.StatusCode, fmt.Sprintf("error response from %v", uri))
+	}
+
+	keys, err := r.parse(body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return keys, cacheTTL(resp.Header.Get("Cache-Control")), nil
+}
+
+// cacheTTL returns the max-age from a Cache-Control header clamped
+// between minKeysTTL and maxKeysTTL
+func cacheTTL(header string) time.Duration {
+	ttl := defaultKeysTTL
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			return minKeysTTL
+		case strings.HasPrefix(directive, "max-age="):
+			if sec, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				ttl = time.Duration(sec) * time.Second
+			}
+		}
+	}
+
+	if ttl < minKeysTTL {
+		return minKeysTTL
+	}
+	if ttl > maxKeysTTL {
+		return maxKeysTTL
+	}
+	return ttl
+}
+
+func filterKeys(keys []JSONWebKey, kid string) []JSONWebKey {
+	if kid == "" {
+		return keys
+	}
+
+	var matched []JSONWebKey
+	for _, k := range keys {
+		if k.KeyID == kid {
+			matched = append(matched, k)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,257 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwksServer serves a JWKS containing kids, each fetch blocks until release is closed
+type jwksServer struct {
+	*httptest.Server
+	fetches int32
+	release chan struct{}
+	mu      sync.Mutex
+	kids    []string
+	fail    bool
+}
+
+func newJWKSServer(t *testing.T, kids ...string) *jwksServer {
+	t.Helper()
+	key := newTestKey(t)
+	s := &jwksServer{release: make(chan struct{}), kids: kids}
+	close(s.release)
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.fetches, 1)
+		<-s.release
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var keys []map[string]string
+		for _, kid := range s.kids {
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"kid": kid,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   "AQAB",
+			})
+		}
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) count() int32 {
+	return atomic.LoadInt32(&s.fetches)
+}
+
+func TestRemoteKeySetCaches(t *testing.T) {
+	s := newJWKSServer(t, "a")
+	r := NewRemoteKeySet(testIssuer, s.URL)
+
+	for i := 0; i < 3; i++ {
+		keys, err := r.Keys(context.Background(), "a")
+		if err != nil || len(keys) != 1 {
+			t.Fatalf("Keys() = %v, %v", keys, err)
+		}
+	}
+	if n := s.count(); n != 1 {
+		t.Fatalf("fetched %d times, want 1", n)
+	}
+
+	// unknown kids are refetched at most once per minRefetchInterval
+	if keys, err := r.Keys(context.Background(), "b"); err != nil || len(keys) != 0 {
+		t.Fatalf("Keys() = %v, %v", keys, err)
+	}
+	if n := s.count(); n != 1 {
+		t.Fatalf("fetched %d times within minRefetchInterval, want 1", n)
+	}
+
+	r.mu.Lock()
+	r.lastFetch = time.Time{}
+	r.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		if keys, err := r.Keys(context.Background(), "b"); err != nil || len(keys) != 0 {
+			t.Fatalf("Keys() = %v, %v", keys, err)
+		}
+	}
+	if n := s.count(); n != 2 {
+		t.Fatalf("fetched %d times, want 2", n)
+	}
+}
+
+func TestRemoteKeySetRotation(t *testing.T) {
+	s := newJWKSServer(t, "a")
+	r := NewRemoteKeySet(testIssuer, s.URL)
+	if _, err := r.Keys(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	s.kids = []string{"b"}
+	s.mu.Unlock()
+	r.mu.Lock()
+	r.lastFetch = time.Time{}
+	r.mu.Unlock()
+
+	keys, err := r.Keys(context.Background(), "b")
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("Keys() after rotation = %v, %v", keys, err)
+	}
+}
+
+func TestRemoteKeySetSingleFlight(t *testing.T) {
+	s := newJWKSServer(t, "a")
+	s.release = make(chan struct{})
+	r := NewRemoteKeySet(testIssuer, s.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if keys, err := r.Keys(context.Background(), "a"); err != nil || len(keys) != 1 {
+				t.Errorf("Keys() = %v, %v", keys, err)
+			}
+		}()
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	close(s.release)
+	wg.Wait()
+
+	if n := s.count(); n != 1 {
+		t.Fatalf("fetched %d times, want 1", n)
+	}
+}
+
+func TestRemoteKeySetServesCachedKeysDuringFetch(t *testing.T) {
+	s := newJWKSServer(t, "a")
+	r := NewRemoteKeySet(testIssuer, s.URL)
+	if _, err := r.Keys(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// block the next fetch, which an unknown kid triggers
+	s.release = make(chan struct{})
+	defer close(s.release)
+	r.mu.Lock()
+	r.lastFetch = time.Time{}
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := r.Keys(ctx, "b"); err != context.DeadlineExceeded {
+		t.Fatalf("Keys() for an unknown kid error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	start := time.Now()
+	keys, err := r.Keys(context.Background(), "a")
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("Keys() = %v, %v", keys, err)
+	}
+	if d := time.Since(start); d > time.Millisecond*20 {
+		t.Fatalf("Keys() for a cached kid waited %v on the fetch", d)
+	}
+}
+
+func TestRemoteKeySetServesStaleKeysOnFailure(t *testing.T) {
+	s := newJWKSServer(t, "a")
+	r := NewRemoteKeySet(testIssuer, s.URL)
+	if _, err := r.Keys(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	s.fail = true
+	s.mu.Unlock()
+	r.mu.Lock()
+	r.expires = time.Now().Add(-time.Second)
+	r.lastFetch = time.Time{}
+	r.mu.Unlock()
+
+	keys, err := r.Keys(context.Background(), "a")
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("Keys() with a failing endpoint = %v, %v", keys, err)
+	}
+}
+
+func TestRemoteKeySetFailsWithoutCachedKeys(t *testing.T) {
+	s := newJWKSServer(t, "a")
+	s.fail = true
+	r := NewRemoteKeySet(testIssuer, s.URL)
+
+	// retries are rate limited like refetches for unknown key IDs
+	for i := 0; i < 3; i++ {
+		if _, err := r.Keys(context.Background(), "a"); err == nil {
+			t.Fatal("Keys() succeeded with a failing endpoint")
+		}
+	}
+	if n := s.count(); n != 1 {
+		t.Fatalf("fetched %d times, want 1", n)
+	}
+
+	s.mu.Lock()
+	s.fail = false
+	s.mu.Unlock()
+	r.mu.Lock()
+	r.failed = time.Time{}
+	r.mu.Unlock()
+
+	keys, err := r.Keys(context.Background(), "a")
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("Keys() after the endpoint recovered = %v, %v", keys, err)
+	}
+}
+
+func TestParseX509Certs(t *testing.T) {
+	key := newTestKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "securetoken"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(map[string]string{
+		"a":       string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		"invalid": "not a certificate",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := ParseX509Certs(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].KeyID != "a" {
+		t.Fatalf("ParseX509Certs() = %v", keys)
+	}
+	if _, err := ParseX509Certs([]byte("[]")); err == nil {
+		t.Fatal("ParseX509Certs() accepted a JSON array")
+	}
+}
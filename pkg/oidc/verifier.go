@@ -0,0 +1,459 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers crypto.SHA256
+	_ "crypto/sha512" // registers crypto.SHA384 and crypto.SHA512
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	RS256 = "RS256"
+	RS384 = "RS384"
+	RS512 = "RS512"
+	PS256 = "PS256"
+	PS384 = "PS384"
+	PS512 = "PS512"
+	ES256 = "ES256"
+	ES384 = "ES384"
+	ES512 = "ES512"
+	EdDSA = "EdDSA"
+
+	// defaultLeeway allows for clock skew, matching the previous Okta verifier
+	defaultLeeway = time.Minute * 2
+)
+
+var (
+	// ErrInvalidSignature is returned when no key in the KeySet verifies the token
+	ErrInvalidSignature = errors.New("invalid token signature")
+
+	// ErrExpired is returned when the token's exp claim has passed
+	ErrExpired = errors.New("token expired")
+
+	// ErrNonce is returned when the nonce claim doesn't match the authentication request
+	ErrNonce = errors.New("nonce mismatch")
+
+	// ErrAuthTooOld is returned when auth_time is older than the requested max age
+	ErrAuthTooOld = errors.New("authentication is older than max age")
+
+	defaultAlgorithms = []string{RS256, RS384, RS512, PS256, PS384, PS512, ES256, ES384, ES512, EdDSA}
+)
+
+type (
+	// VerifierConfig configures a Verifier.
+	VerifierConfig struct {
+		// Issuer must match the iss claim exactly
+		// e.g. "https://oie-1234567.oktapreview.com/oauth2/default"
+		Issuer string
+		// ClientID must be in the aud claim
+		ClientID string
+
+		// KeySet used to verify signatures
+		// default SharedKeySet(Issuer, "")
+		KeySet KeySet
+
+		// Algorithms accepted in the token header
+		// default all supported algorithms
+		Algorithms []string
+
+		// Leeway allowed for clock skew when checking exp, iat, nbf and auth_time
+		// default 2 minutes
+		Leeway time.Duration
+
+		// MaxAge requires auth_time to be within MaxAge, zero disables the check
+		MaxAge time.Duration
+
+		// RequiredClaims must be present in every token
+		// e.g. []string{"email"}
+		RequiredClaims []string
+
+		// Checks are run after the standard validation succeeds
+		Checks []func(token *IDToken) error
+
+		// Now is used for time based checks
+		// default time.Now
+		Now func() time.Time
+
+		// InsecureSkipSignatureCheck accepts tokens without verifying their
+		// signature, only use it for emulators which issue unsigned tokens
+		InsecureSkipSignatureCheck bool
+	}
+
+	// Expected contains values bound to a single authentication request.
+	Expected struct {
+		// Nonce sent in the authentication request, checked when not empty
+		Nonce string
+		// AccessToken issued alongside the ID token, checked against at_hash when not empty
+		AccessToken string
+		// MaxAge overrides VerifierConfig.MaxAge when not zero
+		MaxAge time.Duration
+	}
+
+	// Verifier validates OpenID Connect ID tokens, it is safe for concurrent use.
+	Verifier struct {
+		config     VerifierConfig
+		algorithms map[string]bool
+	}
+
+	// IDToken is a verified ID token.
+	IDToken struct {
+		Raw       string
+		Issuer    string
+		Subject   string
+		Audience  []string
+		Expiry    time.Time
+		IssuedAt  time.Time
+		AuthTime  time.Time // zero if auth_time isn't present
+		Nonce     string
+		Algorithm string
+		Claims    map[string]interface{}
+	}
+
+	header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+		Typ string `json:"typ"`
+	}
+)
+
+func NewVerifier(config VerifierConfig) (*Verifier, error) {
+	if config.Issuer == "" {
+		return nil, errors.New("require Issuer")
+	}
+
+	if config.ClientID == "" {
+		return nil, errors.New("require ClientID")
+	}
+
+	if config.KeySet == nil {
+		config.KeySet = SharedKeySet(config.Issuer, "")
+	}
+
+	if len(config.Algorithms) == 0 {
+		config.Algorithms = defaultAlgorithms
+	}
+
+	if config.Leeway == 0 {
+		config.Leeway = defaultLeeway
+	}
+
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+
+	algorithms := map[string]bool{}
+	for _, alg := range config.Algorithms {
+		if _, ok := algorithmHash(alg); !ok {
+			return nil, errors.Errorf("unsupported algorithm %q", alg)
+		}
+		algorithms[alg] = true
+	}
+
+	return &Verifier{
+		config:     config,
+		algorithms: algorithms,
+	}, nil
+}
+
+// Verify checks the token's signature and standard claims as described in
+// https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+func (v *Verifier) Verify(ctx context.Context, token string, expected Expected) (*IDToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, errors.Wrap(err, "malformed token header")
+	}
+
+	if !v.config.InsecureSkipSignatureCheck {
+		if !v.algorithms[h.Alg] {
+			return nil, errors.Errorf("token algorithm %q not allowed", h.Alg)
+		}
+
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed token signature")
+		}
+
+		if err := v.verifySignature(ctx, h, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+			return nil, err
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(err, "malformed token claims")
+	}
+
+	t, err := newIDToken(token, h.Alg, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := v.verifyClaims(t, expected); err != nil {
+		return nil, err
+	}
+
+	for _, check := range v.config.Checks {
+		if err := check(t); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func (v *Verifier) verifySignature(ctx context.Context, h header, signed, sig []byte) error {
+	keys, err := v.config.KeySet.Keys(ctx, h.Kid)
+	if err != nil {
+		return errors.Wrap(err, "failed to get signing keys")
+	}
+
+	for _, k := range keys {
+		if k.Algorithm != "" && k.Algorithm != h.Alg {
+			continue
+		}
+		if verify(h.Alg, k.Key, signed, sig) == nil {
+			return nil
+		}
+	}
+
+	return ErrInvalidSignature
+}
+
+func (v *Verifier) verifyClaims(t *IDToken, expected Expected) error {
+	now := v.config.Now()
+	leeway := v.config.Leeway
+
+	if t.Issuer != v.config.Issuer {
+		return errors.Errorf("issuer mismatch, expected %q but token contains %q", v.config.Issuer, t.Issuer)
+	}
+
+	if !contains(t.Audience, v.config.ClientID) {
+		return errors.Errorf("token audience %v does not contain %q", t.Audience, v.config.ClientID)
+	}
+
+	azp, _ := t.Claims["azp"].(string)
+	if len(t.Audience) > 1 && azp == "" {
+		return errors.New("require azp claim when token has multiple audiences")
+	}
+	if azp != "" && azp != v.config.ClientID {
+		return errors.Errorf("token authorized party %q is not %q", azp, v.config.ClientID)
+	}
+
+	if t.Expiry.IsZero() {
+		return errors.New("require exp claim")
+	}
+	if !now.Add(-leeway).Before(t.Expiry) {
+		return ErrExpired
+	}
+
+	if t.IssuedAt.IsZero() {
+		return errors.New("require iat claim")
+	}
+	if t.IssuedAt.After(now.Add(leeway)) {
+		return errors.New("token issued in the future")
+	}
+
+	if nbf, ok := numericDate(t.Claims, "nbf"); ok && nbf.After(now.Add(leeway)) {
+		return errors.New("token is not valid yet")
+	}
+
+	if expected.Nonce != "" && subtle.ConstantTimeCompare([]byte(t.Nonce), []byte(expected.Nonce)) != 1 {
+		return ErrNonce
+	}
+
+	if expected.AccessToken != "" {
+		if atHash, ok := t.Claims["at_hash"].(string); ok {
+			if err := verifyAccessTokenHash(t.Algorithm, atHash, expected.AccessToken); err != nil {
+				return err
+			}
+		}
+	}
+
+	maxAge := v.config.MaxAge
+	if expected.MaxAge != 0 {
+		maxAge = expected.MaxAge
+	}
+	if maxAge > 0 {
+		if t.AuthTime.IsZero() {
+			return errors.New("require auth_time claim")
+		}
+		if now.Add(-leeway).After(t.AuthTime.Add(maxAge)) {
+			return ErrAuthTooOld
+		}
+	}
+
+	for _, c := range v.config.RequiredClaims {
+		if _, ok := t.Claims[c]; !ok {
+			return errors.Errorf("require %v claim", c)
+		}
+	}
+
+	return nil
+}
+
+func newIDToken(raw, alg string, claims map[string]interface{}) (*IDToken, error) {
+	t := &IDToken{
+		Raw:       raw,
+		Algorithm: alg,
+		Claims:    claims,
+	}
+
+	t.Issuer, _ = claims["iss"].(string)
+	t.Subject, _ = claims["sub"].(string)
+	t.Nonce, _ = claims["nonce"].(string)
+
+	if t.Subject == "" {
+		return nil, errors.New("require sub claim")
+	}
+
+	switch aud := claims["aud"].(type) {
+	case string:
+		t.Audience = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				t.Audience = append(t.Audience, s)
+			}
+		}
+	}
+
+	t.Expiry, _ = numericDate(claims, "exp")
+	t.IssuedAt, _ = numericDate(claims, "iat")
+	t.AuthTime, _ = numericDate(claims, "auth_time")
+
+	return t, nil
+}
+
+// verify checks sig over signed using key for the JWS algorithm, RFC 7518 section 3
+func verify(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	hash, ok := algorithmHash(alg)
+	if !ok {
+		return errors.Errorf("unsupported algorithm %q", alg)
+	}
+
+	if alg == EdDSA {
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, signed, sig) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrInvalidSignature
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrInvalidSignature
+		}
+		return rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve.Params().BitSize != ecdsaCurveBits(alg) {
+			return ErrInvalidSignature
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+
+	return errors.Errorf("unsupported algorithm %q", alg)
+}
+
+// verifyAccessTokenHash checks the at_hash claim, OpenID Connect Core section 3.1.3.6
+func verifyAccessTokenHash(alg, atHash, accessToken string) error {
+	hash, ok := algorithmHash(alg)
+	if !ok {
+		return errors.Errorf("unsupported algorithm %q", alg)
+	}
+
+	h := hash.New()
+	h.Write([]byte(accessToken))
+	sum := h.Sum(nil)
+	expected := base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(atHash)) != 1 {
+		return errors.New("access token does not match at_hash claim")
+	}
+	return nil
+}
+
+func algorithmHash(alg string) (crypto.Hash, bool) {
+	switch alg {
+	case RS256, PS256, ES256:
+		return crypto.SHA256, true
+	case RS384, PS384, ES384:
+		return crypto.SHA384, true
+	case RS512, PS512, ES512, EdDSA: // Ed25519 uses SHA-512 for at_hash
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+func ecdsaCurveBits(alg string) int {
+	switch alg {
+	case ES256:
+		return 256
+	case ES384:
+		return 384
+	case ES512:
+		return 521
+	}
+	return 0
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func numericDate(claims map[string]interface{}, name string) (time.Time, bool) {
+	f, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
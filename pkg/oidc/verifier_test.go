@@ -0,0 +1,310 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testClientID = "client"
+	testKeyID    = "key-1"
+)
+
+var testNow = time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// signToken encodes header and claims as a JWT signed with key using RS256,
+// the signature is left empty when key is nil
+func signToken(t *testing.T, key *rsa.PrivateKey, header map[string]string, claims map[string]interface{}) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	if key == nil {
+		return signed + "."
+	}
+
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":       testIssuer,
+		"aud":       testClientID,
+		"sub":       "user",
+		"iat":       testNow.Add(-time.Minute).Unix(),
+		"exp":       testNow.Add(time.Hour).Unix(),
+		"auth_time": testNow.Add(-time.Minute).Unix(),
+		"nonce":     "nonce",
+		"email":     "user@example.com",
+	}
+}
+
+func atHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+func TestVerifier(t *testing.T) {
+	key := newTestKey(t)
+	other := newTestKey(t)
+
+	tests := []struct {
+		name     string
+		header   map[string]string
+		claims   func(c map[string]interface{})
+		key      *rsa.PrivateKey // signs the token, default key
+		unsigned bool
+		tamper   bool // replaces the signed claims after signing
+		config   func(c *VerifierConfig)
+		expected Expected
+		wantErr  error // nil with wantOK false accepts any error
+		wantOK   bool
+	}{
+		{
+			name:     "valid",
+			expected: Expected{Nonce: "nonce", AccessToken: "access"},
+			claims:   func(c map[string]interface{}) { c["at_hash"] = atHash("access") },
+			wantOK:   true,
+		},
+		{
+			name:   "multiple audiences with azp",
+			claims: func(c map[string]interface{}) { c["aud"] = []string{testClientID, "other"}; c["azp"] = testClientID },
+			wantOK: true,
+		},
+		{
+			name:   "expired within leeway",
+			claims: func(c map[string]interface{}) { c["exp"] = testNow.Add(-time.Minute).Unix() },
+			wantOK: true,
+		},
+		{
+			name:   "wrong issuer",
+			claims: func(c map[string]interface{}) { c["iss"] = "https://attacker.example.com" },
+		},
+		{
+			name:   "wrong audience",
+			claims: func(c map[string]interface{}) { c["aud"] = "other" },
+		},
+		{
+			name:   "multiple audiences without azp",
+			claims: func(c map[string]interface{}) { c["aud"] = []string{testClientID, "other"} },
+		},
+		{
+			name:   "wrong azp",
+			claims: func(c map[string]interface{}) { c["azp"] = "other" },
+		},
+		{
+			name:    "expired",
+			claims:  func(c map[string]interface{}) { c["exp"] = testNow.Add(-time.Hour).Unix() },
+			wantErr: ErrExpired,
+		},
+		{
+			name:   "missing exp",
+			claims: func(c map[string]interface{}) { delete(c, "exp") },
+		},
+		{
+			name:   "issued in the future",
+			claims: func(c map[string]interface{}) { c["iat"] = testNow.Add(time.Hour).Unix() },
+		},
+		{
+			name:   "not valid yet",
+			claims: func(c map[string]interface{}) { c["nbf"] = testNow.Add(time.Hour).Unix() },
+		},
+		{
+			name:   "missing sub",
+			claims: func(c map[string]interface{}) { delete(c, "sub") },
+		},
+		{
+			name:     "wrong nonce",
+			expected: Expected{Nonce: "other"},
+			wantErr:  ErrNonce,
+		},
+		{
+			name:     "missing nonce",
+			claims:   func(c map[string]interface{}) { delete(c, "nonce") },
+			expected: Expected{Nonce: "nonce"},
+			wantErr:  ErrNonce,
+		},
+		{
+			name:     "at_hash mismatch",
+			claims:   func(c map[string]interface{}) { c["at_hash"] = atHash("other") },
+			expected: Expected{AccessToken: "access"},
+		},
+		{
+			name:     "auth_time too old",
+			expected: Expected{MaxAge: time.Second},
+			claims:   func(c map[string]interface{}) { c["auth_time"] = testNow.Add(-time.Hour).Unix() },
+			wantErr:  ErrAuthTooOld,
+		},
+		{
+			name:     "max age without auth_time",
+			expected: Expected{MaxAge: time.Hour},
+			claims:   func(c map[string]interface{}) { delete(c, "auth_time") },
+		},
+		{
+			name:   "missing required claim",
+			config: func(c *VerifierConfig) { c.RequiredClaims = []string{"groups"} },
+		},
+		{
+			name: "failed check",
+			config: func(c *VerifierConfig) {
+				c.Checks = []func(*IDToken) error{func(*IDToken) error { return errors.New("rejected") }}
+			},
+		},
+		{
+			name:    "signed by another key",
+			key:     other,
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "unknown kid",
+			header:  map[string]string{"alg": RS256, "kid": "key-2"},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "tampered claims",
+			claims:  func(c map[string]interface{}) { c["email"] = "attacker@example.com" },
+			tamper:  true,
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:   "alg not allowed",
+			config: func(c *VerifierConfig) { c.Algorithms = []string{ES256} },
+		},
+		{
+			name:   "alg mismatch with key",
+			header: map[string]string{"alg": PS256, "kid": testKeyID},
+		},
+		{
+			name:     "alg none",
+			header:   map[string]string{"alg": "none"},
+			unsigned: true,
+		},
+		{
+			name:   "alg HS256",
+			header: map[string]string{"alg": "HS256", "kid": testKeyID},
+		},
+		{
+			name:     "alg none with signature check skipped",
+			header:   map[string]string{"alg": "none"},
+			unsigned: true,
+			config:   func(c *VerifierConfig) { c.InsecureSkipSignatureCheck = true },
+			wantOK:   true,
+		},
+		{
+			name:     "claims still checked with signature check skipped",
+			header:   map[string]string{"alg": "none"},
+			claims:   func(c map[string]interface{}) { c["aud"] = "other" },
+			unsigned: true,
+			config:   func(c *VerifierConfig) { c.InsecureSkipSignatureCheck = true },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := VerifierConfig{
+				Issuer:   testIssuer,
+				ClientID: testClientID,
+				KeySet:   StaticKeySet{{KeyID: testKeyID, Key: &key.PublicKey}},
+				Now:      func() time.Time { return testNow },
+			}
+			if tt.config != nil {
+				tt.config(&config)
+			}
+			v, err := NewVerifier(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			header := tt.header
+			if header == nil {
+				header = map[string]string{"alg": RS256, "kid": testKeyID}
+			}
+			claims := validClaims()
+			if tt.claims != nil {
+				tt.claims(claims)
+			}
+
+			signer := key
+			if tt.key != nil {
+				signer = tt.key
+			}
+			if tt.unsigned {
+				signer = nil
+			}
+
+			token := signToken(t, signer, header, claims)
+			if tt.tamper {
+				parts := strings.Split(token, ".")
+				original := strings.Split(signToken(t, signer, header, validClaims()), ".")
+				token = parts[0] + "." + parts[1] + "." + original[2]
+			}
+
+			idToken, err := v.Verify(context.Background(), token, tt.expected)
+			if tt.wantOK {
+				if err != nil {
+					t.Fatalf("Verify() error = %v", err)
+				}
+				if idToken.Subject != "user" || idToken.Claims["email"] != "user@example.com" {
+					t.Fatalf("Verify() = %+v", idToken)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("Verify() succeeded, want an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifierMalformed(t *testing.T) {
+	key := newTestKey(t)
+	v, err := NewVerifier(VerifierConfig{
+		Issuer:   testIssuer,
+		ClientID: testClientID,
+		KeySet:   StaticKeySet{{KeyID: testKeyID, Key: &key.PublicKey}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{"", "a.b", "a.b.c.d", "!.!.!", "e30.e30.!"} {
+		if _, err := v.Verify(context.Background(), token, Expected{}); err == nil {
+			t.Fatalf("Verify(%q) succeeded, want an error", token)
+		}
+	}
+}
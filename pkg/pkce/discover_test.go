@@ -0,0 +1,47 @@
+package pkce
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDiscover(t *testing.T) {
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                        s.URL,
+			"authorization_endpoint":        s.URL + "/authorize",
+			"token_endpoint":                s.URL + "/token",
+			"jwks_uri":                      s.URL + "/keys",
+			"revocation_endpoint":           s.URL + "/revoke",
+			"device_authorization_endpoint": s.URL + "/device",
+		})
+	}))
+	defer s.Close()
+
+	config, err := Discover(context.Background(), Config{
+		Issuer:   s.URL,
+		ClientID: "client",
+		TokenURL: "https://proxy.example.com/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.AuthURL != s.URL+"/authorize" || config.JWKSURL != s.URL+"/keys" || config.RevokeURL != s.URL+"/revoke" || config.DeviceAuthURL != s.URL+"/device" {
+		t.Fatalf("Discover() = %+v", config)
+	}
+	if config.TokenURL != "https://proxy.example.com/token" {
+		t.Fatalf("Discover() replaced TokenURL with %v", config.TokenURL)
+	}
+	if config.UserInfoURL != "" {
+		t.Fatalf("Discover() set UserInfoURL to %v", config.UserInfoURL)
+	}
+
+	if _, err := NewFromIssuer(context.Background(), s.URL+"/", "client"); err == nil {
+		t.Fatal("NewFromIssuer() accepted an issuer which doesn't match the metadata")
+	}
+}
@@ -5,12 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/mousybusiness/authn/internal/errs"
+	"github.com/mousybusiness/authn/internal/loopback"
+	"github.com/mousybusiness/authn/internal/oauth"
 	"github.com/mousybusiness/authn/internal/rstr"
 	"github.com/mousybusiness/authn/internal/static"
 	"github.com/mousybusiness/authn/pkg/creds"
-	"github.com/mousybusiness/go-web/web"
+	"github.com/mousybusiness/authn/pkg/oidc"
 	cv "github.com/nirasan/go-oauth-pkce-code-verifier"
-	"github.com/okta/okta-jwt-verifier-golang"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"net/http"
@@ -21,48 +22,132 @@ import (
 	"time"
 )
 
+// ErrStateMismatch is returned by Auth when the callback fails the state check.
+var ErrStateMismatch = loopback.ErrStateMismatch
+
 type pkceFlow struct {
 	config       Config
 	credentials  *creds.Credentials
 	codeVerifier *cv.CodeVerifier
-	server       *http.Server
-	authWG       *sync.WaitGroup
+	verifier     *oidc.Verifier
+	server       *loopback.Server
+	redirectURL  string // RedirectURL with the listening port substituted
 	nonce        string
 	state        string
+	mu           sync.Mutex                      // guards scope, written by the callback and Refresh
+	scope        string                          // granted by the last token response, reused on refresh
+	maxAge       time.Duration                   // verified against auth_time by the callback
+	check        func(token *oidc.IDToken) error // optional, run by the callback
 }
 
 const (
+	defaultName         = "pkce"
+	defaultTitle        = "Authn"
 	defaultPort         = "63353"
 	defaultRedirectPath = "/login/callback"
 )
 
-var (
-	//https://oauth.net/2/scope/
-	scopes = []string{
-		"email",
-		"profile",
-		"openid",
-		"offline_access",
-	}
-)
+// RedirectServer configures the local redirect server which receives the callback.
+type RedirectServer = loopback.Options
 
 type Config struct {
+	// Name identifies the provider when registered with authn
+	// default "pkce"
+	Name string
+
 	// Title for redirect website
 	// e.g. GooseClip
 	Title string
-	// Port for localhosted redirect server if used
-	// default 63353
-	Port string
+	RedirectServer
 
 	ClientID string
 	Issuer   string // e.g. "https://oie-1234567.oktapreview.com/oauth2/default"
 	AuthURL  string // e.g. "https://oie-1234567.oktapreview.com/oauth2/default/v1/authorize"
 	TokenURL string // e.g. "https://oie-1234567.oktapreview.com/oauth2/default/v1/token"
 
+	// RevokeURL is optional, Revoke will fail without it
+	RevokeURL string // e.g. "https://oie-1234567.oktapreview.com/oauth2/default/v1/revoke"
+
+	// optional endpoints, populated by Discover
+	UserInfoURL   string // e.g. "https://oie-1234567.oktapreview.com/oauth2/default/v1/userinfo"
+	EndSessionURL string // e.g. "https://oie-1234567.oktapreview.com/oauth2/default/v1/logout"
+	DeviceAuthURL string // e.g. "https://oie-1234567.oktapreview.com/oauth2/default/v1/device/authorize"
+	JWKSURL       string // e.g. "https://oie-1234567.oktapreview.com/oauth2/default/v1/keys"
+
+	// RequiredClaims must be present in every ID token
+	// e.g. []string{"email"}
+	RequiredClaims []string
+	// Verify is optional and runs after the standard ID token validation
+	Verify func(token *oidc.IDToken) error
+
+	// Scopes requested by Auth
+	// default []string{"email", "profile", "openid", "offline_access"}
+	Scopes []string
+	// IDP is the ID of an Okta identity provider, skipping the Okta login page
+	// e.g. "0oa1234567890abcdef"
+	IDP string
+	// LoginHint pre-fills the username on the login page
+	LoginHint string
+	// Prompt e.g. "login", "consent" or "select_account"
+	Prompt string
+	// UILocales are space separated BCP 47 language tags
+	// e.g. "en-GB fr"
+	UILocales string
+	// ACRValues are space separated authentication context class references
+	ACRValues string
+	// MaxAge requires the user to have authenticated within MaxAge and
+	// is verified against auth_time, zero isn't sent
+	MaxAge time.Duration
+	// Claims is a JSON encoded OIDC claims request parameter
+	// e.g. `{"id_token":{"email_verified":{"essential":true}}}`
+	Claims string
+	// Params are added to the authorization request
+	Params map[string]string
+
 	RedirectURL  string // e.g. "http://localhost:63353/login/callback"
 	redirectPath string // generated from RedirectURL
 }
 
+// NewFromIssuer creates a flow using only the issuer and client ID,
+// all endpoints are populated using OpenID Connect discovery.
+func NewFromIssuer(ctx context.Context, issuer, clientID string) (*pkceFlow, error) {
+	config, err := Discover(ctx, Config{
+		Title:    defaultTitle,
+		ClientID: clientID,
+		Issuer:   issuer,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return New(config)
+}
+
+// Discover populates any empty endpoints in config from the
+// issuer's /.well-known/openid-configuration document.
+func Discover(ctx context.Context, config Config) (Config, error) {
+	m, err := oidc.Discover(ctx, config.Issuer)
+	if err != nil {
+		return Config{}, errors.Wrap(err, "failed to discover endpoints")
+	}
+
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+
+	fill(&config.AuthURL, m.AuthorizationEndpoint)
+	fill(&config.TokenURL, m.TokenEndpoint)
+	fill(&config.RevokeURL, m.RevocationEndpoint)
+	fill(&config.UserInfoURL, m.UserinfoEndpoint)
+	fill(&config.EndSessionURL, m.EndSessionEndpoint)
+	fill(&config.DeviceAuthURL, m.DeviceAuthorizationEndpoint)
+	fill(&config.JWKSURL, m.JWKSURI)
+
+	return config, nil
+}
+
 func New(config Config) (*pkceFlow, error) {
 	if config.Title == "" {
 		return nil, errors.New("require Title")
@@ -73,7 +158,7 @@ func New(config Config) (*pkceFlow, error) {
 	}
 
 	if config.Issuer == "" {
-		return nil, errors.New("require AuthURL")
+		return nil, errors.New("require Issuer")
 	}
 
 	if config.AuthURL == "" {
@@ -84,13 +169,24 @@ func New(config Config) (*pkceFlow, error) {
 		return nil, errors.New("require TokenURL")
 	}
 
+	if config.Name == "" {
+		config.Name = defaultName
+	}
+
 	if config.Port == "" {
 		config.Port = defaultPort
 	}
 
+	if len(config.Scopes) == 0 {
+		config.Scopes = oauth.DefaultScopes
+	}
+
+	if err := config.authParams().Validate(); err != nil {
+		return nil, err
+	}
+
 	if config.RedirectURL == "" {
-		config.RedirectURL = fmt.Sprintf("http://localhost:%v%v", config.Port, defaultRedirectPath)
-		log.Warn("default redirection URL is unencrypted")
+		config.RedirectURL = config.DefaultRedirectURL(defaultRedirectPath)
 	}
 
 	re := regexp.MustCompile(`^https?://[\w-.:]+(/.+)$`)
@@ -103,36 +199,71 @@ func New(config Config) (*pkceFlow, error) {
 	}
 	config.redirectPath = hits[0][1]
 
+	checks := []func(token *oidc.IDToken) error{}
+	if config.Verify != nil {
+		checks = append(checks, config.Verify)
+	}
+
+	verifier, err := oidc.NewVerifier(oidc.VerifierConfig{
+		Issuer:         config.Issuer,
+		ClientID:       config.ClientID,
+		KeySet:         oidc.SharedKeySet(config.Issuer, config.JWKSURL),
+		RequiredClaims: config.RequiredClaims,
+		Checks:         checks,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	flow := &pkceFlow{}
+	flow.config = config
+	flow.verifier = verifier
 	flow.credentials = &creds.Credentials{}
-	callback = flow.redirectHandler
-	flow.nonce = rstr.RandomString(8)
-	flow.state = rstr.RandomString(16)
 	return flow, nil
 }
 
+// Name returns the name the flow is registered under.
+func (p *pkceFlow) Name() string {
+	return p.config.Name
+}
+
 // Auth implements the PKCE OAuth2 flow.
-func (p *pkceFlow) Auth() *creds.Credentials {
+// It blocks until the redirect callback completes or ctx is done,
+// in which case the returned error wraps ctx.Err() so callers
+// can check for context.Canceled or context.DeadlineExceeded.
+func (p *pkceFlow) Auth(ctx context.Context) (*creds.Credentials, error) {
+	return p.authenticate(ctx, p.config.authParams(), p.config.MaxAge, nil)
+}
+
+// authenticate runs the flow with the authorization request params,
+// check is optional and runs after the ID token is verified
+func (p *pkceFlow) authenticate(ctx context.Context, params oauth.AuthParams, maxAge time.Duration, check func(token *oidc.IDToken) error) (*creds.Credentials, error) {
+	p.maxAge = maxAge
+	p.check = check
+
 	p.codeVerifier, _ = cv.CreateCodeVerifier()
 	codeChallenge := p.codeVerifier.CodeChallengeS256()
 
-	p.authWG = new(sync.WaitGroup)
-	p.authWG.Add(1)
-	p.serve()
+	// regenerated per request so a callback from a previous attempt can't be replayed
+	p.state = rstr.RandomString(32)
+	p.nonce = rstr.RandomString(32)
 
-	s := strings.Join(scopes, " ")
-	params := url.Values{}
-	//params.Add("idp", p.idp) // TODO IDP
-	params.Add("client_id", p.config.ClientID)
-	params.Add("response_type", "code")
-	//params.Add("response_mode", "query") // TODO IDP
-	params.Add("scope", s)
-	params.Add("code_challenge", codeChallenge)
-	params.Add("code_challenge_method", "S256")
-	params.Add("redirect_uri", p.config.RedirectURL)
-	params.Add("state", p.state)
-	params.Add("nonce", p.nonce)
-	uri := p.config.AuthURL + "?" + params.Encode()
+	p.credentials = &creds.Credentials{}
+	if err := p.serve(ctx); err != nil {
+		return nil, err
+	}
+
+	q := url.Values{}
+	q.Add("client_id", p.config.ClientID)
+	q.Add("response_type", "code")
+	q.Add("scope", strings.Join(p.config.Scopes, " "))
+	q.Add("code_challenge", codeChallenge)
+	q.Add("code_challenge_method", "S256")
+	q.Add("redirect_uri", p.redirectURL)
+	q.Add("state", p.state)
+	q.Add("nonce", p.nonce)
+	params.Apply(q)
+	uri := p.config.AuthURL + "?" + q.Encode()
 
 	if static.IsDesktop() {
 		if err := static.Open(uri); err != nil {
@@ -141,30 +272,24 @@ func (p *pkceFlow) Auth() *creds.Credentials {
 	}
 
 	fmt.Printf("Visit the URL for the auth dialog: %v\n", uri)
+	if p.server.Fingerprint != "" {
+		fmt.Printf("The redirect server certificate SHA-256 fingerprint is: %v\n", p.server.Fingerprint)
+	}
 
-	p.authWG.Wait()
-	time.Sleep(time.Second)
-	if err := p.server.Shutdown(context.TODO()); err != nil {
-		log.Error(errors.Wrap(err, "error while shutting down server"))
+	if err := p.server.Wait(ctx); err != nil {
+		return nil, err
 	}
 
-	return p.credentials
+	return p.credentials, nil
 }
 
-func (p *pkceFlow) Refresh(refreshToken creds.RefreshToken) (*creds.Credentials, error) {
-	params := url.Values{}
-	params.Add("grant_type", "refresh_token")
-	params.Add("refresh_token", string(refreshToken))
-	params.Add("client_id", p.config.ClientID)
-	params.Add("scope", strings.Join(scopes, " "))
-	params.Add("redirect_uri", p.config.RedirectURL)
-
-	b := []byte(params.Encode())
-	code, body, err := web.Post(p.config.TokenURL, time.Second*60, b,
-		web.KV{Key: "Accept", Value: "application/json"},
-		web.KV{Key: "Content-Type", Value: "application/x-www-form-urlencoded"},
-		web.KV{Key: "Cache-Control", Value: "no-cache"},
-	)
+func (p *pkceFlow) Refresh(ctx context.Context, refreshToken creds.RefreshToken) (*creds.Credentials, error) {
+	p.mu.Lock()
+	scope := p.scope
+	p.mu.Unlock()
+	params := oauth.RefreshParams(p.config.ClientID, string(refreshToken), scope)
+
+	code, body, err := oauth.PostForm(ctx, p.config.TokenURL, params)
 	if err != nil {
 		return nil, err
 	}
@@ -187,7 +312,9 @@ func (p *pkceFlow) Refresh(refreshToken creds.RefreshToken) (*creds.Credentials,
 		return nil, err
 	}
 
-	uid, err := p.verifyJWT(idToken)
+	jwt, err := p.verifyJWT(ctx, idToken, oidc.Expected{
+		AccessToken: string(accessToken),
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -196,32 +323,48 @@ func (p *pkceFlow) Refresh(refreshToken creds.RefreshToken) (*creds.Credentials,
 	p.credentials.AccessToken = accessToken
 	p.credentials.IDToken = idToken
 	p.credentials.RefreshToken = ref
-	p.credentials.UID = uid
+	p.credentials.UID = jwt.Subject
+	p.credentials.Claims = jwt.Claims
 
 	log.Debugf("refresh successful!")
 
 	return p.credentials, nil
 }
 
+// Revoke invalidates the refresh token using the RFC 7009 revocation endpoint.
+func (p *pkceFlow) Revoke(ctx context.Context, refreshToken creds.RefreshToken) error {
+	if p.config.RevokeURL == "" {
+		return errors.New("require RevokeURL")
+	}
+
+	params := url.Values{}
+	params.Add("token", string(refreshToken))
+	params.Add("token_type_hint", "refresh_token")
+	params.Add("client_id", p.config.ClientID)
+
+	code, _, err := oauth.PostForm(ctx, p.config.RevokeURL, params)
+	if err != nil {
+		return err
+	}
+
+	if code != http.StatusOK {
+		return errs.NewHttpError(code, "error response from token revocation")
+	}
+
+	return nil
+}
+
 // exchangeCode trades the authorization code retrieved from the first OAuth2 leg for a token
-func (p *pkceFlow) exchangeCode(authorizationCode string, callbackURL string) (creds.AccessToken, creds.IDToken, creds.RefreshToken, float64, error) {
-	// set the url and form-encoded data for the POST to the access token endpoint
-	url := p.config.TokenURL
-	codeVerifier := p.codeVerifier.String()
-	data := fmt.Sprintf(
-		"grant_type=authorization_code"+
-			"&client_id=%s"+
-			"&code_verifier=%s"+
-			"&code=%s"+
-			"&redirect_uri=%s",
-		p.config.ClientID, codeVerifier, authorizationCode, callbackURL)
-
-	b := []byte(data)
-	code, body, err := web.Post(url, time.Second*60, b,
-		web.KV{Key: "Accept", Value: "application/json"},
-		web.KV{Key: "Content-Type", Value: "application/x-www-form-urlencoded"},
-		web.KV{Key: "Cache-Control", Value: "no-cache"},
-	)
+func (p *pkceFlow) exchangeCode(ctx context.Context, authorizationCode string, callbackURL string) (creds.AccessToken, creds.IDToken, creds.RefreshToken, float64, error) {
+	// set the form-encoded data for the POST to the access token endpoint
+	params := url.Values{}
+	params.Add("grant_type", "authorization_code")
+	params.Add("client_id", p.config.ClientID)
+	params.Add("code_verifier", p.codeVerifier.String())
+	params.Add("code", authorizationCode)
+	params.Add("redirect_uri", callbackURL)
+
+	code, body, err := oauth.PostForm(ctx, p.config.TokenURL, params)
 	if err != nil {
 		return "", "", "", 0, err
 	}
@@ -265,6 +408,12 @@ func (p *pkceFlow) extractFromResponse(responseData map[string]interface{}) (cre
 		expiresIn = ei
 	}
 
+	if scope, ok := responseData["scope"].(string); ok && scope != "" {
+		p.mu.Lock()
+		p.scope = scope
+		p.mu.Unlock()
+	}
+
 	if idToken != "" && refreshToken != "" && expiresIn != 0 {
 		return creds.AccessToken(accessToken), creds.IDToken(idToken), creds.RefreshToken(refreshToken), expiresIn, nil
 	}
@@ -272,102 +421,103 @@ func (p *pkceFlow) extractFromResponse(responseData map[string]interface{}) (cre
 	return "", "", "", 0, fmt.Errorf("unable to get data from response, accessToken: %v, idToken: %v, refreshToken: %v, expiresIn: %v", accessToken != "", idToken != "", refreshToken != "", expiresIn != 0)
 }
 
-// TODO allow custom verify here
-// TODO verify nonce claim
-func (p *pkceFlow) verifyJWT(token creds.IDToken) (string, error) {
-	toValidate := map[string]string{}
-	toValidate["aud"] = p.config.ClientID
-	toValidate["cid"] = p.config.ClientID
-
-	verifier := jwtverifier.JwtVerifier{
-		Issuer:           p.config.Issuer,
-		ClaimsToValidate: toValidate,
-	}
-
-	jwt, err := verifier.New().VerifyIdToken(string(token))
+// verifyJWT validates the ID token, the nonce and max age are only checked by the
+// callback as ID tokens returned by a refresh aren't bound to an authentication request
+func (p *pkceFlow) verifyJWT(ctx context.Context, token creds.IDToken, expected oidc.Expected) (*oidc.IDToken, error) {
+	jwt, err := p.verifier.Verify(ctx, string(token), expected)
 	if err != nil {
-		return "", err
-	}
-	log.Infof("JWT: %v", jwt.Claims)
-
-	if si, ok := jwt.Claims["sub"]; ok {
-		if uid, ok := si.(string); ok {
-			return uid, nil
-		}
+		return nil, err
 	}
-	return "", errors.New("couldn't extract uid")
-}
+	log.Debugf("JWT: %v", jwt.Claims)
 
-var callback func(w http.ResponseWriter, r *http.Request)
-
-func handlerWrapper(w http.ResponseWriter, r *http.Request) {
-	if callback != nil {
-		callback(w, r)
-	}
+	return jwt, nil
 }
 
-func (p *pkceFlow) serve() {
+// serve starts the redirect server, returning an error if the port can't be bound
+func (p *pkceFlow) serve(ctx context.Context) error {
 	if p.server != nil {
 		_ = p.server.Close()
 	}
 
-	// use server so we can shutdown loter
-	server := &http.Server{
-		Addr: ":" + defaultPort,
+	server, err := loopback.Listen(loopback.Config{
+		Options:     p.config.RedirectServer,
+		RedirectURL: p.config.RedirectURL,
+		Path:        p.config.redirectPath,
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			p.redirectHandler(ctx, w, r)
+		},
+	})
+	if err != nil {
+		return err
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc(p.config.redirectPath, handlerWrapper)
-	server.Handler = mux
-
-	go func() {
-		if err := server.ListenAndServe(); err != nil {
-			if !strings.HasSuffix(err.Error(), "Server closed") {
-				log.Error(errors.Wrap(err, "failed to listen and serve login callback"))
-				return
-			}
-		}
-	}()
-
 	p.server = server
+	p.redirectURL = server.RedirectURL
+	return nil
 }
 
-func (p *pkceFlow) redirectHandler(w http.ResponseWriter, r *http.Request) {
+func (p *pkceFlow) redirectHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
 
-	defer p.authWG.Done() // TODO this will leak if callback isn't hit
+	if !p.server.VerifyState(w, q.Get("state"), p.state, p.config.Title) {
+		return
+	}
+
+	if e := q.Get("error"); e != "" {
+		log.Errorf("error in callback: %v %v", e, q.Get("error_description"))
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintln(w, static.ErrorHTML(p.config.Title, fmt.Sprintf("The identity provider returned an error: %v", e)))
+		p.server.Finish(errors.Errorf("error in callback: %v %v", e, q.Get("error_description")))
+		return
+	}
 
 	// get the authorization code
-	code := r.URL.Query().Get("code")
+	code := q.Get("code")
 	if code == "" {
 		log.Error("code not in callback")
-		w.WriteHeader(http.StatusOK)
+		w.WriteHeader(http.StatusBadRequest)
 		_, _ = fmt.Fprintln(w, static.FailedHTML(p.config.Title))
-		p.fail()
+		p.server.Finish(errors.New("code not in callback"))
 		return
 	}
 
 	// trade the authorization code and the code verifier for an access token
-	accessToken, idToken, refreshToken, expiresIn, err := p.exchangeCode(code, p.config.RedirectURL)
+	accessToken, idToken, refreshToken, expiresIn, err := p.exchangeCode(ctx, code, p.redirectURL)
 	if err != nil {
 		log.Errorf("failed to get token, err: %v", err)
-		w.WriteHeader(http.StatusOK)
+		w.WriteHeader(http.StatusBadGateway)
 		_, _ = fmt.Fprintln(w, static.FailedHTML(p.config.Title))
-		p.fail()
+		p.server.Finish(errors.Wrap(err, "failed to get token"))
 		return
 	}
 
-	uid, err := p.verifyJWT(idToken)
+	jwt, err := p.verifyJWT(ctx, idToken, oidc.Expected{
+		Nonce:       p.nonce,
+		AccessToken: string(accessToken),
+		MaxAge:      p.maxAge,
+	})
 	if err != nil {
-		log.Error("failed to get uid from JWT")
-		w.WriteHeader(http.StatusOK)
-		_, _ = fmt.Fprintln(w, static.FailedHTML(p.config.Title))
-		p.fail()
+		log.Errorf("failed to verify ID token, err: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = fmt.Fprintln(w, static.ErrorHTML(p.config.Title, "The identity token could not be verified."))
+		p.server.Finish(errors.Wrap(err, "failed to verify ID token"))
 		return
 	}
 
+	if p.check != nil {
+		if err := p.check(jwt); err != nil {
+			log.Errorf("ID token rejected, err: %v", err)
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = fmt.Fprintln(w, static.ErrorHTML(p.config.Title, "The login did not meet the required security level."))
+			p.server.Finish(err)
+			return
+		}
+	}
+
 	// assign the idToken globally so it can be returned by Auth
 	p.credentials.Expiry = time.Now().Add(time.Duration(expiresIn-60) * time.Second) // allow 1 minute of buffer
-	p.credentials.UID = uid
+	p.credentials.UID = jwt.Subject
+	p.credentials.Claims = jwt.Claims
 	p.credentials.AccessToken = accessToken
 	p.credentials.IDToken = idToken
 	p.credentials.RefreshToken = refreshToken
@@ -377,14 +527,18 @@ func (p *pkceFlow) redirectHandler(w http.ResponseWriter, r *http.Request) {
 	_, _ = fmt.Fprintln(w, static.SuccessHTML(p.config.Title))
 
 	log.Infof("logged in")
+	p.server.Finish(nil)
 }
 
-// fail closes the HTTP server
-func (p *pkceFlow) fail() {
-	go func() {
-		err := p.server.Close()
-		if err != nil {
-			log.Error(err)
-		}
-	}()
+func (c Config) authParams() oauth.AuthParams {
+	return oauth.AuthParams{
+		IDP:       c.IDP,
+		LoginHint: c.LoginHint,
+		Prompt:    c.Prompt,
+		UILocales: c.UILocales,
+		ACRValues: c.ACRValues,
+		MaxAge:    c.MaxAge,
+		Claims:    c.Claims,
+		Extra:     c.Params,
+	}
 }
@@ -0,0 +1,266 @@
+package pkce
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/mousybusiness/authn/internal/rstr"
+	"github.com/mousybusiness/authn/pkg/oidc"
+	cv "github.com/nirasan/go-oauth-pkce-code-verifier"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID = "client"
+	testKeyID    = "key-1"
+	testCode     = "code"
+)
+
+// testIdP fakes the token and JWKS endpoints, the ID token's claims are
+// built by claims so tests can alter the nonce or authentication context
+type testIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu       sync.Mutex
+	claims   func(nonce string) map[string]interface{}
+	nonce    string
+	requests []url.Values
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &testIdP{key: key}
+	idp.claims = idp.defaultClaims
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		idp.mu.Lock()
+		idp.requests = append(idp.requests, r.PostForm)
+		claims := idp.claims(idp.nonce)
+		idp.mu.Unlock()
+
+		if r.PostForm.Get("grant_type") == "authorization_code" && r.PostForm.Get("code") != testCode {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "access",
+			"id_token":      idp.sign(t, claims),
+			"refresh_token": "refresh",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+			"scope":         "openid email",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": testKeyID,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   "AQAB",
+			}},
+		})
+	})
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *testIdP) defaultClaims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":       idp.URL,
+		"aud":       testClientID,
+		"sub":       "user",
+		"iat":       time.Now().Unix(),
+		"exp":       time.Now().Add(time.Hour).Unix(),
+		"auth_time": time.Now().Unix(),
+		"nonce":     nonce,
+	}
+}
+
+// sign returns an RS256 ID token for claims
+func (idp *testIdP) sign(t *testing.T, claims map[string]interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": testKeyID})
+	c, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Error(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// received returns the form of each token request
+func (idp *testIdP) received() []url.Values {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return idp.requests
+}
+
+func (idp *testIdP) newFlow(t *testing.T) *pkceFlow {
+	t.Helper()
+	p, err := New(Config{
+		Title:          "Test",
+		RedirectServer: RedirectServer{Port: "0"},
+		ClientID:       testClientID,
+		Issuer:         idp.URL,
+		AuthURL:        idp.URL + "/authorize",
+		TokenURL:       idp.URL + "/token",
+		JWKSURL:        idp.URL + "/keys",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// begin prepares p as Auth does without opening the browser, the
+// authorization request's nonce is given to the IdP
+func (idp *testIdP) begin(t *testing.T, p *pkceFlow, check func(token *oidc.IDToken) error) {
+	t.Helper()
+	p.codeVerifier, _ = cv.CreateCodeVerifier()
+	p.state = rstr.RandomString(32)
+	p.nonce = rstr.RandomString(32)
+	p.check = check
+	if err := p.serve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = p.server.Close() })
+
+	idp.mu.Lock()
+	idp.nonce = p.nonce
+	idp.mu.Unlock()
+}
+
+// callback sends the redirect to p and waits for the flow to finish
+func callback(t *testing.T, p *pkceFlow, query url.Values) (int, error) {
+	t.Helper()
+	resp, err := http.Get(p.redirectURL + "?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	return resp.StatusCode, p.server.Wait(ctx)
+}
+
+func TestCallbackState(t *testing.T) {
+	tests := []struct {
+		name  string
+		state func(p *pkceFlow) string
+		want  int
+		err   error
+	}{
+		{name: "matching state", state: func(p *pkceFlow) string { return p.state }, want: http.StatusOK},
+		{name: "missing state", state: func(p *pkceFlow) string { return "" }, want: http.StatusBadRequest, err: ErrStateMismatch},
+		{name: "other state", state: func(p *pkceFlow) string { return rstr.RandomString(32) }, want: http.StatusBadRequest, err: ErrStateMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newTestIdP(t)
+			p := idp.newFlow(t)
+			idp.begin(t, p, nil)
+
+			status, err := callback(t, p, url.Values{"state": {tt.state(p)}, "code": {testCode}})
+			if status != tt.want {
+				t.Fatalf("status = %d, want %d", status, tt.want)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+
+			if tt.err != nil {
+				if n := len(idp.received()); n != 0 {
+					t.Fatalf("made %d token requests for a rejected callback", n)
+				}
+				return
+			}
+			if p.credentials.UID != "user" || p.credentials.RefreshToken != "refresh" {
+				t.Fatalf("credentials = %+v", p.credentials)
+			}
+			req := idp.received()[0]
+			if req.Get("code_verifier") != p.codeVerifier.String() || req.Get("redirect_uri") != p.redirectURL {
+				t.Fatalf("token request = %v", req)
+			}
+		})
+	}
+}
+
+func TestCallbackNonce(t *testing.T) {
+	tests := []struct {
+		name    string
+		nonce   func(nonce string) string
+		wantErr bool
+	}{
+		{name: "matching nonce", nonce: func(nonce string) string { return nonce }},
+		{name: "missing nonce", nonce: func(nonce string) string { return "" }, wantErr: true},
+		{name: "other nonce", nonce: func(nonce string) string { return nonce + "x" }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newTestIdP(t)
+			idp.claims = func(nonce string) map[string]interface{} {
+				claims := idp.defaultClaims(tt.nonce(nonce))
+				if claims["nonce"] == "" {
+					delete(claims, "nonce")
+				}
+				return claims
+			}
+			p := idp.newFlow(t)
+			idp.begin(t, p, nil)
+
+			status, err := callback(t, p, url.Values{"state": {p.state}, "code": {testCode}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && status != http.StatusUnauthorized {
+				t.Fatalf("status = %d, want %d", status, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestRefreshDoesntRequireNonce(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.claims = func(string) map[string]interface{} {
+		claims := idp.defaultClaims("")
+		delete(claims, "nonce")
+		return claims
+	}
+	p := idp.newFlow(t)
+
+	c, err := p.Refresh(context.Background(), "refresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UID != "user" {
+		t.Fatalf("UID = %q, want user", c.UID)
+	}
+}
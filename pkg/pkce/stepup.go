@@ -0,0 +1,123 @@
+package pkce
+
+import (
+	"context"
+	"fmt"
+	"github.com/mousybusiness/authn/pkg/creds"
+	"github.com/mousybusiness/authn/pkg/oidc"
+	"strings"
+	"time"
+)
+
+// stepUpSkew allows for clock differences between the CLI and the identity provider
+const stepUpSkew = time.Minute
+
+type (
+	// StepUp describes the assurance required by StepUp.
+	StepUp struct {
+		// MaxAge is sent as max_age, zero isn't sent. The login is always
+		// forced with prompt=login and auth_time must be after StepUp began.
+		MaxAge time.Duration
+		// ACRValues are requested in order of preference and the
+		// ID token's acr claim must be one of them
+		// e.g. []string{"urn:okta:loa:2fa:any"}
+		ACRValues []string
+		// AMR methods which must all be present in the ID token's amr claim
+		// e.g. []string{"mfa"}
+		AMR []string
+	}
+
+	// StepUpError is returned by StepUp when the ID token
+	// doesn't satisfy the requested assurance.
+	StepUpError struct {
+		// Claim which wasn't satisfied, "auth_time", "acr" or "amr"
+		Claim string
+		Want  string
+		Got   string
+	}
+)
+
+func (e *StepUpError) Error() string {
+	return fmt.Sprintf("step-up authentication not satisfied: %v is %q, want %v", e.Claim, e.Got, e.Want)
+}
+
+// StepUp forces the user to log in again, e.g. before running an admin command,
+// and verifies the ID token's auth_time, acr and amr claims. A *StepUpError
+// is returned when the identity provider didn't satisfy the request.
+func (p *pkceFlow) StepUp(ctx context.Context, req StepUp) (*creds.Credentials, error) {
+	params := p.config.authParams()
+	params.Prompt = "login"
+	params.MaxAge = req.MaxAge
+	if len(req.ACRValues) > 0 {
+		params.ACRValues = strings.Join(req.ACRValues, " ")
+	}
+
+	// freshness is checked against when StepUp began rather than by the
+	// verifier, so a stale login is reported as a StepUpError
+	started := time.Now()
+	return p.authenticate(ctx, params, 0, func(token *oidc.IDToken) error {
+		return req.verify(token, started)
+	})
+}
+
+func (s StepUp) verify(token *oidc.IDToken, started time.Time) error {
+	if token.AuthTime.IsZero() {
+		return &StepUpError{Claim: "auth_time", Want: "present"}
+	}
+
+	if token.AuthTime.Before(started.Add(-stepUpSkew)) {
+		return &StepUpError{
+			Claim: "auth_time",
+			Want:  fmt.Sprintf("after %v", started.UTC().Format(time.RFC3339)),
+			Got:   token.AuthTime.UTC().Format(time.RFC3339),
+		}
+	}
+
+	if len(s.ACRValues) > 0 {
+		acr, _ := token.Claims["acr"].(string)
+		accepted := false
+		for _, v := range s.ACRValues {
+			if v == acr {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return &StepUpError{
+				Claim: "acr",
+				Want:  fmt.Sprintf("one of %v", strings.Join(s.ACRValues, ", ")),
+				Got:   acr,
+			}
+		}
+	}
+
+	if len(s.AMR) > 0 {
+		amr := stringsClaim(token.Claims["amr"])
+		methods := make(map[string]bool, len(amr))
+		for _, m := range amr {
+			methods[m] = true
+		}
+		for _, m := range s.AMR {
+			if !methods[m] {
+				return &StepUpError{
+					Claim: "amr",
+					Want:  fmt.Sprintf("all of %v", strings.Join(s.AMR, ", ")),
+					Got:   strings.Join(amr, " "),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func stringsClaim(v interface{}) []string {
+	values, _ := v.([]interface{})
+	s := make([]string, 0, len(values))
+	for _, value := range values {
+		if str, ok := value.(string); ok {
+			s = append(s, str)
+		}
+	}
+	return s
+}
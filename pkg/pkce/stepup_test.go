@@ -0,0 +1,106 @@
+package pkce
+
+import (
+	"github.com/mousybusiness/authn/pkg/oidc"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestStepUpVerify(t *testing.T) {
+	started := time.Now()
+	fresh := started.Add(time.Second)
+
+	tests := []struct {
+		name  string
+		req   StepUp
+		token oidc.IDToken
+		claim string // of the expected StepUpError, empty if satisfied
+	}{
+		{name: "fresh login", token: oidc.IDToken{AuthTime: fresh}},
+		{name: "within skew", token: oidc.IDToken{AuthTime: started.Add(-stepUpSkew / 2)}},
+		{name: "missing auth_time", token: oidc.IDToken{}, claim: "auth_time"},
+		{name: "stale login", token: oidc.IDToken{AuthTime: started.Add(-time.Hour)}, claim: "auth_time"},
+		{
+			name:  "accepted acr",
+			req:   StepUp{ACRValues: []string{"urn:okta:loa:2fa:any", "phr"}},
+			token: oidc.IDToken{AuthTime: fresh, Claims: map[string]interface{}{"acr": "phr"}},
+		},
+		{
+			name:  "other acr",
+			req:   StepUp{ACRValues: []string{"urn:okta:loa:2fa:any"}},
+			token: oidc.IDToken{AuthTime: fresh, Claims: map[string]interface{}{"acr": "urn:okta:loa:1fa:any"}},
+			claim: "acr",
+		},
+		{
+			name:  "missing acr",
+			req:   StepUp{ACRValues: []string{"urn:okta:loa:2fa:any"}},
+			token: oidc.IDToken{AuthTime: fresh, Claims: map[string]interface{}{}},
+			claim: "acr",
+		},
+		{
+			name:  "all amr present",
+			req:   StepUp{AMR: []string{"mfa", "pwd"}},
+			token: oidc.IDToken{AuthTime: fresh, Claims: map[string]interface{}{"amr": []interface{}{"pwd", "otp", "mfa"}}},
+		},
+		{
+			name:  "amr missing a method",
+			req:   StepUp{AMR: []string{"mfa"}},
+			token: oidc.IDToken{AuthTime: fresh, Claims: map[string]interface{}{"amr": []interface{}{"pwd"}}},
+			claim: "amr",
+		},
+		{
+			name:  "amr not an array",
+			req:   StepUp{AMR: []string{"mfa"}},
+			token: oidc.IDToken{AuthTime: fresh, Claims: map[string]interface{}{"amr": "mfa"}},
+			claim: "amr",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.req.verify(&tt.token, started)
+			if tt.claim == "" {
+				if err != nil {
+					t.Fatalf("verify() = %v, want nil", err)
+				}
+				return
+			}
+
+			var stepUpErr *StepUpError
+			if !errors.As(err, &stepUpErr) || stepUpErr.Claim != tt.claim {
+				t.Fatalf("verify() = %v, want a StepUpError for %v", err, tt.claim)
+			}
+		})
+	}
+}
+
+func TestStepUpCallbackRejectsUnsatisfiedLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.claims = func(nonce string) map[string]interface{} {
+		claims := idp.defaultClaims(nonce)
+		claims["amr"] = []string{"pwd"}
+		return claims
+	}
+	p := idp.newFlow(t)
+
+	req := StepUp{AMR: []string{"mfa"}}
+	started := time.Now()
+	idp.begin(t, p, func(token *oidc.IDToken) error {
+		return req.verify(token, started)
+	})
+
+	status, err := callback(t, p, url.Values{"state": {p.state}, "code": {testCode}})
+	if status != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", status, http.StatusForbidden)
+	}
+	var stepUpErr *StepUpError
+	if !errors.As(err, &stepUpErr) || stepUpErr.Claim != "amr" {
+		t.Fatalf("err = %v, want a StepUpError for amr", err)
+	}
+	if p.credentials.RefreshToken != "" {
+		t.Fatal("credentials were set for a rejected login")
+	}
+}
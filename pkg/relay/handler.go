@@ -0,0 +1,310 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/mousybusiness/authn/internal/static"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTTL         = time.Minute * 5
+	defaultPollTimeout = time.Second * 25
+	defaultMaxSessions = 10000
+	// sweepInterval limits how often expired sessions are swept when the limit is reached
+	sweepInterval = time.Second * 10
+	// maxStartRequest is far larger than a state
+	maxStartRequest = 1 << 10
+)
+
+type (
+	// Config for the relay Handler
+	Config struct {
+		// Title for the redirect website
+		// e.g. GooseClip
+		Title string
+		// CallbackPath receives the redirect from the identity provider
+		// default DefaultCallbackPath
+		CallbackPath string
+		// PollPath is polled by the CLI, which starts the session by posting its state to it
+		// default DefaultPollPath
+		PollPath string
+		// Authenticate is optional and rejects requests to start a session when
+		// it returns an error, e.g. to only accept clients of a known network.
+		// Without it anyone can start sessions up to MaxSessions.
+		Authenticate func(r *http.Request) error
+		// TTL of sessions from when they're started
+		// default 5 minutes
+		TTL time.Duration
+		// PollTimeout is how long a poll waits for the redirect before
+		// responding with 204 No Content, it should be shorter than
+		// the timeouts of any proxies in front of the relay
+		// default 25 seconds
+		PollTimeout time.Duration
+		// MaxSessions limits the number of sessions held in memory
+		// default 10000
+		MaxSessions int
+	}
+
+	// Handler is the hosted side of the relay. Sessions are held in memory
+	// so the relay must run as a single instance.
+	Handler struct {
+		config    Config
+		mu        sync.Mutex
+		sessions  map[string]*session
+		lastSweep time.Time
+	}
+
+	session struct {
+		publicKey [32]byte // from the state the session was started with
+		sealed    []byte
+		expires   time.Time
+		ready     chan struct{}
+		collected bool // kept until the TTL so the callback can't be replayed
+	}
+)
+
+// NewHandler creates a relay which can be served with net/http, e.g.
+//
+//	http.Handle("/__/auth/", relay.NewHandler(relay.Config{Title: "GooseClip"}))
+func NewHandler(config Config) *Handler {
+	if config.CallbackPath == "" {
+		config.CallbackPath = DefaultCallbackPath
+	}
+
+	if config.PollPath == "" {
+		config.PollPath = DefaultPollPath
+	}
+
+	if config.TTL == 0 {
+		config.TTL = defaultTTL
+	}
+
+	if config.PollTimeout == 0 {
+		config.PollTimeout = defaultPollTimeout
+	}
+
+	if config.MaxSessions == 0 {
+		config.MaxSessions = defaultMaxSessions
+	}
+
+	return &Handler{
+		config:   config,
+		sessions: make(map[string]*session),
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch {
+	case r.URL.Path == h.config.CallbackPath && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		h.callback(w, r)
+	case r.URL.Path == h.config.PollPath && r.Method == http.MethodGet:
+		h.poll(w, r)
+	case r.URL.Path == h.config.PollPath && r.Method == http.MethodPost:
+		h.start(w, r)
+	case r.URL.Path == h.config.CallbackPath || r.URL.Path == h.config.PollPath:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// start creates the session for the state posted by Session.Start,
+// redirects and polls are only accepted for sessions which were started
+func (h *Handler) start(w http.ResponseWriter, r *http.Request) {
+	if h.config.Authenticate != nil {
+		if err := h.config.Authenticate(r); err != nil {
+			log.Debugf("rejected relay session: %v", err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var req startRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxStartRequest)).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	id, publicKey, err := parseState(req.State)
+	if err != nil {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.session(id, now); ok {
+		http.Error(w, "session already started", http.StatusConflict)
+		return
+	}
+
+	if len(h.sessions) >= h.config.MaxSessions {
+		h.sweep(now)
+	}
+
+	if len(h.sessions) >= h.config.MaxSessions {
+		log.Warn("relay session limit reached")
+		http.Error(w, "too many sessions", http.StatusServiceUnavailable)
+		return
+	}
+
+	h.sessions[id] = &session{
+		publicKey: *publicKey,
+		expires:   now.Add(h.config.TTL),
+		ready:     make(chan struct{}),
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// callback seals the redirect to the session key, providers
+// such as Apple post the callback rather than redirecting
+func (h *Handler) callback(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid callback", http.StatusBadRequest)
+		return
+	}
+	q := r.Form
+
+	id, publicKey, err := parseState(q.Get("state"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintln(w, static.ErrorHTML(h.config.Title, "The login request could not be verified, please try again."))
+		return
+	}
+
+	b, err := json.Marshal(Result{
+		Code:             q.Get("code"),
+		State:            q.Get("state"),
+		Error:            q.Get("error"),
+		ErrorDescription: q.Get("error_description"),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = fmt.Fprintln(w, static.FailedHTML(h.config.Title))
+		return
+	}
+
+	sealed, err := seal(b, publicKey)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = fmt.Fprintln(w, static.FailedHTML(h.config.Title))
+		return
+	}
+
+	h.mu.Lock()
+	s, ok := h.session(id, time.Now())
+	if !ok {
+		h.mu.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintln(w, static.ErrorHTML(h.config.Title, "The login request has expired, please try again."))
+		return
+	}
+	if subtle.ConstantTimeCompare(s.publicKey[:], publicKey[:]) != 1 {
+		h.mu.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintln(w, static.ErrorHTML(h.config.Title, "The login request could not be verified, please try again."))
+		return
+	}
+	if s.sealed != nil {
+		h.mu.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		_, _ = fmt.Fprintln(w, static.ErrorHTML(h.config.Title, "This login has already been completed."))
+		return
+	}
+	s.sealed = sealed
+	close(s.ready)
+	h.mu.Unlock()
+
+	if e := q.Get("error"); e != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintln(w, static.ErrorHTML(h.config.Title, fmt.Sprintf("The identity provider returned an error: %v", e)))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintln(w, static.SuccessHTML(h.config.Title))
+}
+
+// poll waits for the sealed result, which can only be collected once
+func (h *Handler) poll(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("session")
+	if b, err := base64.RawURLEncoding.DecodeString(id); err != nil || len(b) != sessionIDLength {
+		http.Error(w, "invalid session", http.StatusBadRequest)
+		return
+	}
+
+	h.mu.Lock()
+	s, ok := h.session(id, time.Now())
+	h.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	select {
+	case <-s.ready:
+	case <-time.After(h.config.PollTimeout):
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	h.mu.Lock()
+	if s.collected {
+		h.mu.Unlock()
+		http.Error(w, "session already collected", http.StatusGone)
+		return
+	}
+	s.collected = true
+	sealed := s.sealed
+	s.sealed = []byte{}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(pollResponse{
+		Sealed: base64.RawURLEncoding.EncodeToString(sealed),
+	})
+}
+
+// session returns the started session for id, removing it if it has expired,
+// h.mu must be held
+func (h *Handler) session(id string, now time.Time) (*session, bool) {
+	s, ok := h.sessions[id]
+	if !ok {
+		return nil, false
+	}
+
+	if now.After(s.expires) {
+		delete(h.sessions, id)
+		return nil, false
+	}
+	return s, true
+}
+
+// sweep removes expired sessions at most once per sweepInterval, h.mu must be held
+func (h *Handler) sweep(now time.Time) {
+	if now.Sub(h.lastSweep) < sweepInterval {
+		return
+	}
+	h.lastSweep = now
+
+	for id, s := range h.sessions {
+		if now.After(s.expires) {
+			delete(h.sessions, id)
+		}
+	}
+}
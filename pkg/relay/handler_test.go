@@ -0,0 +1,200 @@
+package relay
+
+import (
+	"context"
+	"github.com/mousybusiness/authn/internal/errs"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRelay(t *testing.T, config Config) (*Handler, *httptest.Server) {
+	t.Helper()
+	h := NewHandler(config)
+	s := httptest.NewServer(h)
+	t.Cleanup(s.Close)
+	return h, s
+}
+
+func newTestSession(t *testing.T) *Session {
+	t.Helper()
+	s, err := NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// redirect sends the identity provider's redirect to the relay callback
+func redirect(t *testing.T, server *httptest.Server, q url.Values) int {
+	t.Helper()
+	resp, err := http.Get(server.URL + DefaultCallbackPath + "?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func get(t *testing.T, uri string) int {
+	t.Helper()
+	resp, err := http.Get(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRelay(t *testing.T) {
+	_, server := newTestRelay(t, Config{})
+	session := newTestSession(t)
+	pollURL := server.URL + DefaultPollPath
+
+	if err := session.Start(context.Background(), pollURL); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Start(context.Background(), pollURL); err == nil {
+		t.Fatal("Start() succeeded twice for the same session")
+	}
+
+	if code := redirect(t, server, url.Values{"code": {"auth-code"}, "state": {session.State()}}); code != http.StatusOK {
+		t.Fatalf("callback status = %v", code)
+	}
+
+	r, err := session.Poll(context.Background(), pollURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Code != "auth-code" {
+		t.Fatalf("Poll() code = %q", r.Code)
+	}
+
+	// the result can't be collected or replaced again
+	if code := get(t, pollURL+"?session="+session.ID()); code != http.StatusGone {
+		t.Fatalf("second poll status = %v, want %v", code, http.StatusGone)
+	}
+	if code := redirect(t, server, url.Values{"code": {"other"}, "state": {session.State()}}); code != http.StatusConflict {
+		t.Fatalf("second callback status = %v, want %v", code, http.StatusConflict)
+	}
+}
+
+func TestRelayWaitsForCallback(t *testing.T) {
+	_, server := newTestRelay(t, Config{})
+	session := newTestSession(t)
+	pollURL := server.URL + DefaultPollPath
+	if err := session.Start(context.Background(), pollURL); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		redirect(t, server, url.Values{"error": {"access_denied"}, "state": {session.State()}})
+	}()
+
+	r, err := session.Poll(context.Background(), pollURL)
+	if err == nil || r.Error != "access_denied" {
+		t.Fatalf("Poll() = %+v, %v, want the provider's error", r, err)
+	}
+}
+
+func TestRelayRejectsUnstartedSessions(t *testing.T) {
+	h, server := newTestRelay(t, Config{})
+	session := newTestSession(t)
+
+	if code := get(t, server.URL+DefaultPollPath+"?session="+session.ID()); code != http.StatusNotFound {
+		t.Fatalf("poll status = %v, want %v", code, http.StatusNotFound)
+	}
+	if code := get(t, server.URL+DefaultPollPath+"?session=short"); code != http.StatusBadRequest {
+		t.Fatalf("poll status = %v, want %v", code, http.StatusBadRequest)
+	}
+	if code := redirect(t, server, url.Values{"code": {"auth-code"}, "state": {session.State()}}); code != http.StatusBadRequest {
+		t.Fatalf("callback status = %v, want %v", code, http.StatusBadRequest)
+	}
+
+	_, err := session.Poll(context.Background(), server.URL+DefaultPollPath)
+	if code, ok := errs.ExtractHttpError(err); !ok || code != http.StatusNotFound {
+		t.Fatalf("Poll() error = %v, want %v", err, http.StatusNotFound)
+	}
+
+	if n := len(h.sessions); n != 0 {
+		t.Fatalf("%d sessions allocated by requests which didn't start one", n)
+	}
+}
+
+func TestRelayRejectsAnotherKey(t *testing.T) {
+	_, server := newTestRelay(t, Config{})
+	session := newTestSession(t)
+	if err := session.Start(context.Background(), server.URL+DefaultPollPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// same session ID, attacker's key
+	other := newTestSession(t)
+	state := session.ID() + other.State()[strings.Index(other.State(), "."):]
+	if code := redirect(t, server, url.Values{"code": {"auth-code"}, "state": {state}}); code != http.StatusBadRequest {
+		t.Fatalf("callback status = %v, want %v", code, http.StatusBadRequest)
+	}
+}
+
+func TestRelayExpiresSessions(t *testing.T) {
+	h, server := newTestRelay(t, Config{TTL: time.Millisecond * 50, MaxSessions: 2})
+	pollURL := server.URL + DefaultPollPath
+
+	sessions := []*Session{newTestSession(t), newTestSession(t), newTestSession(t), newTestSession(t)}
+	for _, s := range sessions[:2] {
+		if err := s.Start(context.Background(), pollURL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// expired sessions are swept to make room
+	time.Sleep(time.Millisecond * 100)
+	if err := sessions[2].Start(context.Background(), pollURL); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(h.sessions); n != 1 {
+		t.Fatalf("%d sessions held, want 1", n)
+	}
+	if code := get(t, pollURL+"?session="+sessions[0].ID()); code != http.StatusNotFound {
+		t.Fatalf("poll status for an expired session = %v, want %v", code, http.StatusNotFound)
+	}
+
+	if err := sessions[3].Start(context.Background(), pollURL); err != nil {
+		t.Fatal(err)
+	}
+	err := newTestSession(t).Start(context.Background(), pollURL)
+	if code, ok := errs.ExtractHttpError(err); !ok || code != http.StatusServiceUnavailable {
+		t.Fatalf("Start() error = %v, want %v", err, http.StatusServiceUnavailable)
+	}
+}
+
+func TestRelayAuthenticate(t *testing.T) {
+	_, server := newTestRelay(t, Config{
+		Authenticate: func(r *http.Request) error {
+			return errors.New("unknown client")
+		},
+	})
+
+	err := newTestSession(t).Start(context.Background(), server.URL+DefaultPollPath)
+	if code, ok := errs.ExtractHttpError(err); !ok || code != http.StatusUnauthorized {
+		t.Fatalf("Start() error = %v, want %v", err, http.StatusUnauthorized)
+	}
+}
+
+func TestRelayPollTimeout(t *testing.T) {
+	_, server := newTestRelay(t, Config{PollTimeout: time.Millisecond * 50})
+	session := newTestSession(t)
+	pollURL := server.URL + DefaultPollPath
+	if err := session.Start(context.Background(), pollURL); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := get(t, pollURL+"?session="+session.ID()); code != http.StatusNoContent {
+		t.Fatalf("poll status = %v, want %v", code, http.StatusNoContent)
+	}
+}
@@ -0,0 +1,80 @@
+// Package relay lets a CLI receive an OAuth redirect through a hosted HTTPS
+// page rather than a loopback server. The CLI generates a session key pair
+// and sends the session ID and public key as the OAuth state, the Handler
+// receives the redirect, seals the code to the session key and holds it until
+// the CLI collects it from the poll endpoint. The relay never sees the code
+// in a form which can be read by anyone else polling the session.
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/nacl/box"
+	"strings"
+)
+
+const (
+	// DefaultCallbackPath receives the redirect from the identity provider
+	DefaultCallbackPath = "/__/auth/handler"
+	// DefaultPollPath is polled by the CLI for the sealed result
+	DefaultPollPath = "/__/auth/poll"
+
+	sessionIDLength = 16
+)
+
+var (
+	// ErrInvalidState is returned when the state isn't a relay session
+	ErrInvalidState = errors.New("invalid relay state")
+
+	// ErrSealed is returned when the result can't be opened with the session key
+	ErrSealed = errors.New("failed to open relay result")
+)
+
+type (
+	// Result of the redirect, sealed to the session key while held by the relay
+	Result struct {
+		Code             string `json:"code,omitempty"`
+		State            string `json:"state"`
+		Error            string `json:"error,omitempty"`
+		ErrorDescription string `json:"error_description,omitempty"`
+	}
+
+	// startRequest is posted to the poll endpoint to start a session
+	startRequest struct {
+		State string `json:"state"`
+	}
+
+	// pollResponse is returned by the poll endpoint once the result is ready
+	pollResponse struct {
+		Sealed string `json:"sealed"`
+	}
+)
+
+// parseState returns the session ID and public key from a state
+// created by Session.State
+func parseState(state string) (string, *[32]byte, error) {
+	parts := strings.Split(state, ".")
+	if len(parts) != 2 {
+		return "", nil, ErrInvalidState
+	}
+
+	id, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(id) != sessionIDLength {
+		return "", nil, ErrInvalidState
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(b) != 32 {
+		return "", nil, ErrInvalidState
+	}
+
+	var key [32]byte
+	copy(key[:], b)
+	return parts[0], &key, nil
+}
+
+// seal encrypts b so only the holder of the session private key can read it
+func seal(b []byte, publicKey *[32]byte) ([]byte, error) {
+	return box.SealAnonymous(nil, b, publicKey, rand.Reader)
+}
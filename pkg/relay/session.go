@@ -0,0 +1,191 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/mousybusiness/authn/internal/errs"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/nacl/box"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const retryInterval = time.Second * 2
+
+// Session is the CLI side of the relay, a new session should be used for every login.
+type Session struct {
+	id         string
+	publicKey  *[32]byte
+	privateKey *[32]byte
+}
+
+// NewSession generates a session ID and key pair.
+func NewSession() (*Session, error) {
+	id := make([]byte, sessionIDLength)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errors.Wrap(err, "failed to generate session id")
+	}
+
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate session key")
+	}
+
+	return &Session{
+		id:         base64.RawURLEncoding.EncodeToString(id),
+		publicKey:  publicKey,
+		privateKey: privateKey,
+	}, nil
+}
+
+// ID of the session used when polling.
+func (s *Session) ID() string {
+	return s.id
+}
+
+// State to send as the OAuth state parameter, it contains the session ID
+// and public key and is unguessable so also protects against CSRF.
+func (s *Session) State() string {
+	return s.id + "." + base64.RawURLEncoding.EncodeToString(s.publicKey[:])
+}
+
+// Start registers the session with the relay at pollURL, which only accepts
+// the redirect and polls for sessions which have been started.
+func (s *Session) Start(ctx context.Context, pollURL string) error {
+	b, err := json.Marshal(startRequest{State: s.State()})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pollURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to start relay session")
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusCreated {
+		return errs.NewHttpError(resp.StatusCode, "error response from relay")
+	}
+	return nil
+}
+
+// Poll long-polls pollURL until the relay has received the redirect or ctx is done.
+func (s *Session) Poll(ctx context.Context, pollURL string) (Result, error) {
+	u, err := url.Parse(pollURL)
+	if err != nil {
+		return Result{}, errors.Wrap(err, "invalid poll url")
+	}
+	q := u.Query()
+	q.Set("session", s.id)
+	u.RawQuery = q.Encode()
+
+	for {
+		sealed, err := s.poll(ctx, u.String())
+		if err != nil {
+			if ctx.Err() != nil {
+				return Result{}, errors.Wrap(ctx.Err(), "authentication cancelled")
+			}
+
+			if code, ok := errs.ExtractHttpError(err); ok && code < http.StatusInternalServerError {
+				return Result{}, err
+			}
+
+			log.Debugf("relay poll failed, retrying: %v", err)
+			select {
+			case <-ctx.Done():
+				return Result{}, errors.Wrap(ctx.Err(), "authentication cancelled")
+			case <-time.After(retryInterval):
+			}
+			continue
+		}
+
+		if sealed == nil {
+			continue // the poll timed out before the redirect arrived
+		}
+
+		return s.Open(sealed)
+	}
+}
+
+// poll returns nil when the result isn't ready
+func (s *Session) poll(ctx context.Context, uri string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return nil, nil
+	default:
+		return nil, errs.NewHttpError(resp.StatusCode, "error response from relay")
+	}
+
+	var r pollResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, errors.Wrap(err, "invalid relay response")
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(r.Sealed)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid relay response")
+	}
+
+	return sealed, nil
+}
+
+// Open decrypts a sealed result and checks it belongs to this session.
+func (s *Session) Open(sealed []byte) (Result, error) {
+	b, ok := box.OpenAnonymous(nil, sealed, s.publicKey, s.privateKey)
+	if !ok {
+		return Result{}, ErrSealed
+	}
+
+	var r Result
+	if err := json.Unmarshal(b, &r); err != nil {
+		return Result{}, errors.Wrap(err, "invalid relay result")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.State), []byte(s.State())) != 1 {
+		return Result{}, ErrInvalidState
+	}
+
+	if r.Error != "" {
+		return r, errors.Errorf("error in callback: %v %v", r.Error, r.ErrorDescription)
+	}
+
+	if r.Code == "" {
+		return r, errors.New("code not in callback")
+	}
+
+	return r, nil
+}